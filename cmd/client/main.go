@@ -1,13 +1,26 @@
 package main
 
 import (
+	"flag"
+	"log"
 	"twopc/pkg/client"
 	"twopc/pkg/common"
 )
 
 func main() {
+	configPath := flag.String("config", "", "cluster config file; without it the master is on localhost")
+	flag.Parse()
 
-	c := client.NewMasterClient(common.MasterPort)
+	masterHost := common.MasterPort
+	if *configPath != "" {
+		cluster, err := common.LoadClusterConfig(*configPath)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		masterHost = cluster.Master.Advertise
+	}
+
+	c := client.NewMasterClient(masterHost)
 
 	// test put get alone
 	err := c.Put("alice", "john")
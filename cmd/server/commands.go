@@ -0,0 +1,289 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"twopc/pkg/client"
+	"twopc/pkg/common"
+	"twopc/pkg/replica"
+)
+
+// loadCluster reads the cluster config file, or without one lays out
+// replicaCount replicas on localhost.
+func loadCluster(configPath string, replicaCount int) *common.ClusterConfig {
+	if configPath == "" {
+		return common.DefaultClusterConfig(replicaCount)
+	}
+	cluster, err := common.LoadClusterConfig(configPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return cluster
+}
+
+func replicaNode(cluster *common.ClusterConfig, num int) common.NodeConfig {
+	node, err := cluster.Replica(num)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return node
+}
+
+// parseReplicaList parses comma separated replica indexes.
+func parseReplicaList(s string) (nums []int, err error) {
+	if s == "" {
+		return
+	}
+	for _, f := range strings.Split(s, ",") {
+		num, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil {
+			return nil, errors.New("bad replica index: " + f)
+		}
+		nums = append(nums, num)
+	}
+	return
+}
+
+// runBackup asks a running replica for a snapshot and writes it to a directory.
+func runBackup(args []string) {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	configPath := fs.String("config", "", "cluster config file")
+	replicaNumber := fs.Int("replicaIndex", 0, "replica index to back up, starting at 0")
+	dir := fs.String("dir", "", "directory to write the backup to")
+	_ = fs.Parse(args)
+
+	if *dir == "" {
+		log.Fatalln("backup: -dir is required")
+	}
+
+	node := replicaNode(loadCluster(*configPath, *replicaNumber+1), *replicaNumber)
+	c := client.NewReplicaClient(node.Advertise)
+	snapshot, err := c.Snapshot()
+	if err != nil {
+		log.Fatalln("backup:", err)
+	}
+	err = replica.WriteBackup(*dir, snapshot)
+	if err != nil {
+		log.Fatalln("backup:", err)
+	}
+	log.Println("Backed up replica", *replicaNumber, "at log position", snapshot.LogPosition, "to", *dir)
+}
+
+// runRestore replaces the data of a stopped replica with a backup.
+func runRestore(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	configPath := fs.String("config", "", "cluster config file")
+	replicaNumber := fs.Int("replicaIndex", 0, "replica index to restore, starting at 0")
+	dir := fs.String("dir", "", "directory holding the backup")
+	_ = fs.Parse(args)
+
+	if *dir == "" {
+		log.Fatalln("restore: -dir is required")
+	}
+
+	node := replicaNode(loadCluster(*configPath, *replicaNumber+1), *replicaNumber)
+	err := replica.RestoreBackup(*dir, node)
+	if err != nil {
+		log.Fatalln("restore:", err)
+	}
+	log.Println("Restored replica", *replicaNumber, "from", *dir)
+}
+
+// runRotateKeys re-encrypts the data of a stopped replica with the newest key.
+func runRotateKeys(args []string) {
+	fs := flag.NewFlagSet("rotatekeys", flag.ExitOnError)
+	configPath := fs.String("config", "", "cluster config file")
+	replicaNumber := fs.Int("replicaIndex", 0, "replica index to re-encrypt, starting at 0")
+	keyFile := fs.String("keyFile", "", "key file whose last key becomes the active one")
+	_ = fs.Parse(args)
+
+	if *keyFile == "" {
+		log.Fatalln("rotatekeys: -keyFile is required")
+	}
+
+	node := replicaNode(loadCluster(*configPath, *replicaNumber+1), *replicaNumber)
+	rotated, err := replica.RotateKeys(node, *keyFile)
+	if err != nil {
+		log.Fatalln("rotatekeys:", err)
+	}
+	log.Println("Re-encrypted", rotated, "values of replica", *replicaNumber)
+}
+
+// runLocks prints the lock tables of the cluster, or of a single replica.
+func runLocks(args []string) {
+	fs := flag.NewFlagSet("locks", flag.ExitOnError)
+	configPath := fs.String("config", "", "cluster config file")
+	replicaNumber := fs.Int("replicaIndex", -1, "replica index to ask directly, -1 for the whole cluster through the master")
+	_ = fs.Parse(args)
+
+	cluster := loadCluster(*configPath, *replicaNumber+1)
+	var locks []client.LockInfo
+	if *replicaNumber >= 0 {
+		var err error
+		locks, err = client.NewReplicaClient(replicaNode(cluster, *replicaNumber).Advertise).Locks()
+		if err != nil {
+			log.Fatalln("locks:", err)
+		}
+	} else {
+		result, err := client.NewMasterClient(cluster.Master.Advertise).Locks()
+		if err != nil {
+			log.Fatalln("locks:", err)
+		}
+		locks = result.Locks
+		for _, i := range result.Unreachable {
+			log.Println("locks: replica", i, "is unreachable")
+		}
+	}
+
+	sort.Slice(locks, func(i, j int) bool {
+		a, b := locks[i], locks[j]
+		if a.Replica != b.Replica {
+			return a.Replica < b.Replica
+		}
+		if a.Key != b.Key {
+			return a.Key < b.Key
+		}
+		if a.Waiting != b.Waiting {
+			return !a.Waiting
+		}
+		return a.Age > b.Age
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "WHERE\tKEY\tTX\tMODE\tSTATUS\tTX STATE\tAGE")
+	for _, l := range locks {
+		where := fmt.Sprint("replica ", l.Replica)
+		if l.Replica < 0 {
+			where = "master"
+		}
+		status := "held"
+		if l.Waiting {
+			status = "waiting"
+		}
+		_, _ = fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", where, l.Key, l.TxId, l.Mode, status, l.State.String(), l.Age.Round(time.Millisecond))
+	}
+	_ = w.Flush()
+}
+
+// runMembers prints the master's view of which replicas are up, and the
+// latest changes to it.
+func runMembers(args []string) {
+	fs := flag.NewFlagSet("members", flag.ExitOnError)
+	configPath := fs.String("config", "", "cluster config file")
+	_ = fs.Parse(args)
+
+	result, err := client.NewMasterClient(loadCluster(*configPath, 0).Master.Advertise).Membership()
+	if err != nil {
+		log.Fatalln("members:", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "REPLICA\tGROUP\tSTATUS\tLAST HEARTBEAT\tHINTS\tREAD LATENCY\tREAD ERRORS")
+	for _, m := range result.Members {
+		status := "up"
+		if !m.Alive {
+			status = "down"
+		}
+		_, _ = fmt.Fprintf(w, "%v\t%v\t%v\t%v ago\t%v\t%v\t%.0f%%\n", m.Replica, m.Group, status, m.LastSeen.Round(time.Millisecond), m.Hints, m.ReadLatency.Round(time.Microsecond), 100*m.ReadErrors)
+	}
+	_ = w.Flush()
+
+	for _, e := range result.Events {
+		status := "up"
+		if !e.Alive {
+			status = "down"
+		}
+		fmt.Println(e.At.Format(time.RFC3339), "replica", e.Replica, status)
+	}
+}
+
+// runAddReplica makes a running, empty replica a participant.
+func runAddReplica(args []string) {
+	fs := flag.NewFlagSet("addreplica", flag.ExitOnError)
+	configPath := fs.String("config", "", "cluster config file")
+	replicaNumber := fs.Int("replicaIndex", -1, "replica index to add")
+	group := fs.Int("group", -1, "replica group to join, by default the one in the cluster config")
+	_ = fs.Parse(args)
+
+	if *replicaNumber < 0 {
+		log.Fatalln("addreplica: -replicaIndex is required")
+	}
+
+	cluster := loadCluster(*configPath, *replicaNumber+1)
+	node := replicaNode(cluster, *replicaNumber)
+	if *group < 0 {
+		*group = node.Group
+	}
+	err := client.NewMasterClient(cluster.Master.Advertise).AddReplica(*replicaNumber, node.Advertise, *group)
+	if err != nil {
+		log.Fatalln("addreplica:", err)
+	}
+	log.Println("Replica", *replicaNumber, "at", node.Advertise, "is now a participant of group", *group)
+}
+
+// runRemoveReplica stops the master from sending txs to a replica.
+func runRemoveReplica(args []string) {
+	fs := flag.NewFlagSet("removereplica", flag.ExitOnError)
+	configPath := fs.String("config", "", "cluster config file")
+	replicaNumber := fs.Int("replicaIndex", -1, "replica index to remove")
+	_ = fs.Parse(args)
+
+	if *replicaNumber < 0 {
+		log.Fatalln("removereplica: -replicaIndex is required")
+	}
+
+	err := client.NewMasterClient(loadCluster(*configPath, 0).Master.Advertise).RemoveReplica(*replicaNumber)
+	if err != nil {
+		log.Fatalln("removereplica:", err)
+	}
+	log.Println("Replica", *replicaNumber, "is no longer a participant")
+}
+
+// runRebuild replaces a participant, typically one whose data was lost, with a
+// running, empty replica at the address the config gives it.
+func runRebuild(args []string) {
+	fs := flag.NewFlagSet("rebuild", flag.ExitOnError)
+	configPath := fs.String("config", "", "cluster config file")
+	replicaNumber := fs.Int("replicaIndex", -1, "replica index to rebuild")
+	_ = fs.Parse(args)
+
+	if *replicaNumber < 0 {
+		log.Fatalln("rebuild: -replicaIndex is required")
+	}
+
+	cluster := loadCluster(*configPath, *replicaNumber+1)
+	node := replicaNode(cluster, *replicaNumber)
+	err := client.NewMasterClient(cluster.Master.Advertise).RebuildReplica(*replicaNumber, node.Advertise)
+	if err != nil {
+		log.Fatalln("rebuild:", err)
+	}
+	log.Println("Rebuilt replica", *replicaNumber, "at", node.Advertise)
+}
+
+// runRebalance moves a key range to another replica group.
+func runRebalance(args []string) {
+	fs := flag.NewFlagSet("rebalance", flag.ExitOnError)
+	configPath := fs.String("config", "", "cluster config file")
+	start := fs.String("start", "", "first key of the range to move")
+	end := fs.String("end", "", "key the range ends before, empty for no end")
+	group := fs.Int("group", -1, "replica group to move the range to")
+	_ = fs.Parse(args)
+
+	if *group < 0 {
+		log.Fatalln("rebalance: -group is required")
+	}
+
+	copied, err := client.NewMasterClient(loadCluster(*configPath, 0).Master.Advertise).Rebalance(*start, *end, *group)
+	if err != nil {
+		log.Fatalln("rebalance:", err)
+	}
+	log.Printf("Keys from %q up to %q now belong to group %v, copied %v versions\n", *start, *end, *group, *copied)
+}
@@ -4,27 +4,100 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"os"
 	"strconv"
+	"time"
+	"twopc/pkg/lock"
 	"twopc/pkg/master"
 	"twopc/pkg/replica"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "backup":
+			runBackup(os.Args[2:])
+			return
+		case "restore":
+			runRestore(os.Args[2:])
+			return
+		case "rotatekeys":
+			runRotateKeys(os.Args[2:])
+			return
+		case "locks":
+			runLocks(os.Args[2:])
+			return
+		case "members":
+			runMembers(os.Args[2:])
+			return
+		case "addreplica":
+			runAddReplica(os.Args[2:])
+			return
+		case "removereplica":
+			runRemoveReplica(os.Args[2:])
+			return
+		case "rebuild":
+			runRebuild(os.Args[2:])
+			return
+		case "rebalance":
+			runRebalance(os.Args[2:])
+			return
+		}
+	}
+
+	configPath := flag.String("config", "", "cluster config file, see common.ClusterConfig; without it all nodes run on localhost")
 	isMaster := flag.Bool("master", false, "start the master process")
-	replicaCount := flag.Int("replicaCount", 0, "replica count for master")
+	replicaCount := flag.Int("replicaCount", 0, "replica count for master, without -config")
+	groupCount := flag.Int("groupCount", 1, "number of replica groups to shard keys over, without -config")
+	writeQuorum := flag.String("writeQuorum", "all", "replicas of a group that must vote yes for a put or del: all or majority")
+	readPolicy := flag.String("readPolicy", "least-loaded", "how the master picks the replica a read goes to: least-loaded, nearest, pinned or random")
+	pinnedReplicas := flag.String("pinnedReplicas", "", "comma separated replicas reads go to first with -readPolicy pinned")
 
 	isReplica := flag.Bool("replica", false, "start a replica process")
 	replicaNumber := flag.Int("replicaIndex", 0, "replica index to run, starting at 0")
+	keyFile := flag.String("keyFile", "", "key file used to encrypt replica data at rest")
+	compress := flag.Bool("compress", false, "compress replica values at rest")
+	lockTimeout := flag.Duration("lockTimeout", time.Second, "how long a replica mutation waits for a locked key")
+	deadlockPolicy := flag.String("deadlockPolicy", "wait", "replica lock conflict policy: wait, wait-die or wound-wait")
+	leaseDuration := flag.Duration("leaseDuration", 5*time.Second, "how long a replica keeps a tx's locks without the master renewing them, 0 for ever")
+	inDoubtAlert := flag.Duration("inDoubtAlert", time.Minute, "how long a prepared tx may stay unresolved before the replica raises an alert")
 
 	flag.Parse()
 
 	switch {
 	case *isMaster:
 		log.SetPrefix("M  ")
-		master.RunMaster(*replicaCount)
+		cluster := loadCluster(*configPath, *replicaCount)
+		if *configPath == "" && *groupCount > 1 {
+			cluster.SplitGroups(*groupCount)
+		}
+		quorum, err := master.ParseWriteQuorum(*writeQuorum)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		readsBy, err := master.ParseReadPolicy(*readPolicy)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		pinned, err := parseReplicaList(*pinnedReplicas)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		master.RunMaster(cluster, master.Options{WriteQuorum: quorum, ReadPolicy: readsBy, PinnedReplicas: pinned})
 	case *isReplica:
 		log.SetPrefix(fmt.Sprint("R", strconv.Itoa(*replicaNumber), " "))
-		replica.RunReplica(*replicaNumber)
+		policy, err := lock.ParsePolicy(*deadlockPolicy)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		replica.RunReplica(loadCluster(*configPath, *replicaNumber+1), *replicaNumber, replica.Options{
+			KeyFile:        *keyFile,
+			Compress:       *compress,
+			LockTimeout:    *lockTimeout,
+			DeadlockPolicy: policy,
+			LeaseDuration:  *leaseDuration,
+			InDoubtAlert:   *inDoubtAlert,
+		})
 	default:
 		flag.Usage()
 	}
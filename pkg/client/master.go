@@ -5,6 +5,7 @@ import (
 	"log"
 	"net"
 	"net/rpc"
+	"time"
 	"twopc/pkg/common"
 )
 
@@ -13,7 +14,28 @@ type IMasterClient interface {
 	Del(key string) (err error)
 	Put(key string, value string) (err error)
 	Ping(key string) (Value *string, err error)
-	Status(txid string) (State *common.TxState, err error)
+	Status(txid string) (Result *StatusResult, err error)
+	ReportWaitFor(replicaNum int, edges []WaitForEdge) (err error)
+	DeadlockStats() (Stats *DeadlockStatsResult, err error)
+	Wound(txid string) (err error)
+	Locks() (Result *LocksResult, err error)
+	Heartbeat(replicaNum int, incarnation string, address string, empty bool) (Discard *bool, err error)
+	Membership() (Result *MembershipResult, err error)
+	AddReplica(replicaNum int, address string) (err error)
+	RemoveReplica(replicaNum int) (err error)
+	RebuildReplica(replicaNum int, address string) (err error)
+
+	Begin(isolation common.Isolation) (TxId *string, err error)
+	TxGet(txid string, key string) (Value *string, err error)
+	TxPut(txid string, key string, value string) (err error)
+	TxDel(txid string, key string) (err error)
+	CommitTx(txid string) (err error)
+	AbortTx(txid string) (err error)
+	LockPath(txid string, path string, exclusive bool) (err error)
+
+	BeginOptimistic() *OptimisticTx
+	VersionedGet(key string) (Result *VersionedGetResult, err error)
+	CommitOptimistic(reads []ReadVersion, writes []OptimisticWrite) (err error)
 }
 
 type MasterClient struct {
@@ -161,7 +183,7 @@ func (c *MasterClient) Ping(key string) (Value *string, err error) {
 	return
 }
 
-func (c *MasterClient) Status(txid string) (State *common.TxState, err error) {
+func (c *MasterClient) Status(txid string) (Result *StatusResult, err error) {
 	if err = c.tryConnect(); err != nil {
 		return
 	}
@@ -173,7 +195,314 @@ func (c *MasterClient) Status(txid string) (State *common.TxState, err error) {
 		return
 	}
 
-	State = &reply.State
+	Result = &reply
+
+	return
+}
+
+func (c *MasterClient) ReportWaitFor(replicaNum int, edges []WaitForEdge) (err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply int
+	err = c.call("Master.ReportWaitFor", &WaitForArgs{replicaNum, edges}, &reply)
+	if err != nil {
+		log.Println("MasterClient.ReportWaitFor:", err)
+		return
+	}
+
+	return
+}
+
+func (c *MasterClient) DeadlockStats() (Stats *DeadlockStatsResult, err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply DeadlockStatsResult
+	err = c.call("Master.DeadlockStats", &DeadlockStatsArgs{}, &reply)
+	if err != nil {
+		log.Println("MasterClient.DeadlockStats:", err)
+		return
+	}
+
+	Stats = &reply
+
+	return
+}
+
+func (c *MasterClient) Wound(txid string) (err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply int
+	err = c.call("Master.Wound", &TxArgs{txid}, &reply)
+	if err != nil {
+		log.Println("MasterClient.Wound:", err)
+		return
+	}
+
+	return
+}
+
+func (c *MasterClient) Locks() (Result *LocksResult, err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply LocksResult
+	err = c.call("Master.Locks", &LocksArgs{}, &reply)
+	if err != nil {
+		log.Println("MasterClient.Locks:", err)
+		return
+	}
+
+	Result = &reply
+
+	return
+}
+
+func (c *MasterClient) Heartbeat(replicaNum int, incarnation string, address string, empty bool) (Discard *bool, err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply HeartbeatResult
+	err = c.call("Master.Heartbeat", &HeartbeatArgs{replicaNum, incarnation, address, empty}, &reply)
+	if err != nil {
+		return
+	}
+
+	Discard = &reply.Discard
+
+	return
+}
+
+func (c *MasterClient) Membership() (Result *MembershipResult, err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply MembershipResult
+	err = c.call("Master.Membership", &MembershipArgs{}, &reply)
+	if err != nil {
+		log.Println("MasterClient.Membership:", err)
+		return
+	}
+
+	Result = &reply
+
+	return
+}
+
+// AddReplica makes the running, empty replica at address a participant of
+// replica group group.
+func (c *MasterClient) AddReplica(replicaNum int, address string, group int) (err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply int
+	err = c.call("Master.AddReplica", &AddReplicaArgs{replicaNum, address, group}, &reply)
+	if err != nil {
+		log.Println("MasterClient.AddReplica:", err)
+	}
+	return
+}
+
+func (c *MasterClient) RemoveReplica(replicaNum int) (err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply int
+	err = c.call("Master.RemoveReplica", &RemoveReplicaArgs{replicaNum}, &reply)
+	if err != nil {
+		log.Println("MasterClient.RemoveReplica:", err)
+	}
+	return
+}
+
+// RebuildReplica makes the running, empty replica at address a copy of a
+// peer and puts it in place of participant replicaNum.
+func (c *MasterClient) RebuildReplica(replicaNum int, address string) (err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply int
+	err = c.call("Master.RebuildReplica", &RebuildReplicaArgs{replicaNum, address}, &reply)
+	if err != nil {
+		log.Println("MasterClient.RebuildReplica:", err)
+	}
+	return
+}
+
+// Rebalance moves the keys from start up to end to replica group group while
+// txs go on, and returns how many key versions it copied there.
+func (c *MasterClient) Rebalance(start string, end string, group int) (Copied *int, err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply RebalanceResult
+	err = c.call("Master.Rebalance", &RebalanceArgs{start, end, group}, &reply)
+	if err != nil {
+		log.Println("MasterClient.Rebalance:", err)
+		return
+	}
+	Copied = &reply.Copied
+
+	return
+}
+
+// Begin starts an interactive tx. With common.Locking its reads and writes
+// lock keys until CommitTx or AbortTx, with the snapshot levels it reads as of
+// its start instead. Any error other than a missing key aborts it.
+func (c *MasterClient) Begin(isolation common.Isolation) (TxId *string, err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply BeginResult
+	err = c.call("Master.Begin", &BeginArgs{isolation}, &reply)
+	if err != nil {
+		log.Println("MasterClient.Begin:", err)
+		return
+	}
+
+	TxId = &reply.TxId
+
+	return
+}
+
+// TxGet returns a nil Value if key doesn't exist.
+func (c *MasterClient) TxGet(txid string, key string) (Value *string, err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply TxGetResult
+	err = c.call("Master.TxGet", &TxGetArgs{key, txid, ""}, &reply)
+	if err != nil {
+		log.Println("MasterClient.TxGet:", err)
+		return
+	}
+
+	if reply.Found {
+		Value = &reply.Value
+	}
+
+	return
+}
+
+func (c *MasterClient) TxPut(txid string, key string, value string) (err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply int
+	err = c.call("Master.TxPut", &TxPutArgs{key, value, txid, common.ReplicaDontDie, nil, ""}, &reply)
+	if err != nil {
+		log.Println("MasterClient.TxPut:", err)
+		return
+	}
+
+	return
+}
+
+func (c *MasterClient) TxDel(txid string, key string) (err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply int
+	err = c.call("Master.TxDel", &TxDelArgs{key, txid, common.ReplicaDontDie, nil, ""}, &reply)
+	if err != nil {
+		log.Println("MasterClient.TxDel:", err)
+		return
+	}
+
+	return
+}
+
+func (c *MasterClient) CommitTx(txid string) (err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply int
+	err = c.call("Master.CommitTx", &TxArgs{txid}, &reply)
+	if err != nil {
+		log.Println("MasterClient.CommitTx:", err)
+		return
+	}
+
+	return
+}
+
+func (c *MasterClient) AbortTx(txid string) (err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply int
+	err = c.call("Master.AbortTx", &TxArgs{txid}, &reply)
+	if err != nil {
+		log.Println("MasterClient.AbortTx:", err)
+		return
+	}
+
+	return
+}
+
+// LockPath locks the namespace or table path, e.g. "ns" or "ns/table", for
+// the rest of the tx: shared to read all of it, exclusive to change all of it.
+func (c *MasterClient) LockPath(txid string, path string, exclusive bool) (err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply int
+	err = c.call("Master.LockPath", &LockPathArgs{txid, path, exclusive}, &reply)
+	if err != nil {
+		log.Println("MasterClient.LockPath:", err)
+		return
+	}
+
+	return
+}
+
+func (c *MasterClient) VersionedGet(key string) (Result *VersionedGetResult, err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply VersionedGetResult
+	err = c.call("Master.VersionedGet", &GetArgs{key}, &reply)
+	if err != nil {
+		log.Println("MasterClient.VersionedGet:", err)
+		return
+	}
+
+	Result = &reply
+
+	return
+}
+
+func (c *MasterClient) CommitOptimistic(reads []ReadVersion, writes []OptimisticWrite) (err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply int
+	err = c.call("Master.CommitOptimistic", &OptimisticCommitArgs{reads, writes}, &reply)
+	if err != nil {
+		log.Println("MasterClient.CommitOptimistic:", err)
+		return
+	}
 
 	return
 }
@@ -228,6 +557,140 @@ type StatusArgs struct {
 	TxId string
 }
 
+// StatusResult carries the timestamp the tx committed at, if it did.
 type StatusResult struct {
-	State common.TxState
+	State    common.TxState
+	CommitTs string
+}
+
+// ----------------------------------------------------------------------
+
+type BeginArgs struct {
+	Isolation common.Isolation
+}
+
+type BeginResult struct {
+	TxId string
+}
+
+type TxArgs struct {
+	TxId string
+}
+
+type LockPathArgs struct {
+	TxId      string
+	Path      string
+	Exclusive bool
+}
+
+// ----------------------------------------------------------------------
+
+type WaitForEdge struct {
+	Waiter string
+	Holder string
+	Key    string
+}
+
+// WaitForArgs replaces everything replica ReplicaNum reported before.
+type WaitForArgs struct {
+	ReplicaNum int
+	Edges      []WaitForEdge
+}
+
+type DeadlockStatsArgs struct {
+}
+
+type DeadlockStatsResult struct {
+	CyclesDetected int
+	VictimsAborted int
+	LastCycle      []string
+	Wounded        int
+}
+
+// ----------------------------------------------------------------------
+
+// OptimisticWrite is a buffered write of an optimistic tx, a delete if Del.
+type OptimisticWrite struct {
+	Key   string
+	Value string
+	Del   bool
+}
+
+type OptimisticCommitArgs struct {
+	Reads  []ReadVersion
+	Writes []OptimisticWrite
+}
+
+// ----------------------------------------------------------------------
+
+// HeartbeatArgs says which copy of a replica's data is up, and where.
+type HeartbeatArgs struct {
+	ReplicaNum  int
+	Incarnation string
+	Address     string
+	Empty       bool
+}
+
+// HeartbeatResult tells a replica that was replaced while it was away to
+// drop its data.
+type HeartbeatResult struct {
+	Discard bool
+}
+
+type MembershipArgs struct {
+}
+
+// MemberStatus is the master's view of a replica. LastSeen is the time since
+// its last heartbeat.
+type MemberStatus struct {
+	Replica  int
+	Group    int
+	Alive    bool
+	LastSeen time.Duration
+	// Hints counts the writes it missed that are still to be replayed.
+	Hints int
+	// ReadLatency and ReadErrors are the average latency and error rate of
+	// the reads the master sent it.
+	ReadLatency time.Duration
+	ReadErrors  float64
+}
+
+type MembershipEvent struct {
+	Replica int
+	Alive   bool
+	At      time.Time
+}
+
+// MembershipResult holds the latest membership changes, oldest first.
+type MembershipResult struct {
+	Members []MemberStatus
+	Events  []MembershipEvent
+}
+
+type AddReplicaArgs struct {
+	ReplicaNum int
+	Address    string
+	Group      int
+}
+
+type RemoveReplicaArgs struct {
+	ReplicaNum int
+}
+
+type RebuildReplicaArgs struct {
+	ReplicaNum int
+	Address    string
+}
+
+// RebalanceArgs names the keys from Start up to, not including, End. An empty
+// End has no upper bound.
+type RebalanceArgs struct {
+	Start string
+	End   string
+	Group int
+}
+
+// RebalanceResult counts the key versions copied to the new group.
+type RebalanceResult struct {
+	Copied int
 }
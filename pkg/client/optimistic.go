@@ -0,0 +1,79 @@
+package client
+
+import "errors"
+
+var (
+	ConflictError = errors.New("key changed since the transaction first read it")
+)
+
+// OptimisticTx reads without taking locks and keeps its writes to itself
+// until Commit. The replicas then check that nothing it read has changed
+// since; if something has, Commit fails and the tx must be retried.
+type OptimisticTx struct {
+	c      *MasterClient
+	reads  map[string]string
+	writes map[string]OptimisticWrite
+	// order keeps writes in the order they were made.
+	order []string
+}
+
+func (c *MasterClient) BeginOptimistic() *OptimisticTx {
+	return &OptimisticTx{
+		c:      c,
+		reads:  make(map[string]string),
+		writes: make(map[string]OptimisticWrite),
+	}
+}
+
+// Get returns the value of key as seen by the tx, or nil if there is none.
+func (t *OptimisticTx) Get(key string) (Value *string, err error) {
+	if w, ok := t.writes[key]; ok {
+		if w.Del {
+			return nil, nil
+		}
+		return &w.Value, nil
+	}
+
+	r, err := t.c.VersionedGet(key)
+	if err != nil {
+		return
+	}
+	if version, ok := t.reads[key]; ok && version != r.Version {
+		// Can't be serialized with what we read before, no use going on
+		return nil, ConflictError
+	}
+	t.reads[key] = r.Version
+	if r.Found {
+		Value = &r.Value
+	}
+	return
+}
+
+func (t *OptimisticTx) Put(key string, value string) {
+	t.write(OptimisticWrite{Key: key, Value: value})
+}
+
+func (t *OptimisticTx) Del(key string) {
+	t.write(OptimisticWrite{Key: key, Del: true})
+}
+
+func (t *OptimisticTx) write(w OptimisticWrite) {
+	if _, ok := t.writes[w.Key]; !ok {
+		t.order = append(t.order, w.Key)
+	}
+	t.writes[w.Key] = w
+}
+
+// Commit validates the reads and applies the writes on every replica, or
+// does neither.
+func (t *OptimisticTx) Commit() (err error) {
+	reads := make([]ReadVersion, 0, len(t.reads))
+	for key, version := range t.reads {
+		reads = append(reads, ReadVersion{key, version})
+	}
+	writes := make([]OptimisticWrite, 0, len(t.order))
+	for _, key := range t.order {
+		writes = append(writes, t.writes[key])
+	}
+	return t.c.CommitOptimistic(reads, writes)
+}
@@ -2,33 +2,57 @@ package client
 
 import (
 	"errors"
-	"fmt"
 	"log"
 	"net"
 	"net/rpc"
+	"sync"
+	"time"
 	"twopc/pkg/common"
+	"twopc/pkg/merkle"
 )
 
 type IReplicaClient interface {
 	TryPut(key string, value string, txid string, die common.ReplicaDeath) (Success *bool, err error)
 	Get(key string) (Value *string, err error)
 	TryDel(key string, txid string, die common.ReplicaDeath) (Success *bool, err error)
-	Commit(txid string, die common.ReplicaDeath) (Success *bool, err error)
+	Commit(txid string, commitTs string, die common.ReplicaDeath) (Success *bool, err error)
 	Abort(txid string) (Success *bool, err error)
+	Snapshot() (Snapshot *SnapshotResult, err error)
+	TxGet(key string, txid string, snapshot string) (Result *TxGetResult, err error)
+	RenewLeases(txids []string) (err error)
+	VersionedGet(key string) (Result *VersionedGetResult, err error)
+	TryPutOptimistic(key string, value string, txid string, reads []ReadVersion) (Success *bool, err error)
+	TryDelOptimistic(key string, txid string, reads []ReadVersion) (Success *bool, err error)
+	TryPutSnapshot(key string, value string, txid string, snapshot string) (Success *bool, err error)
+	TryDelSnapshot(key string, txid string, snapshot string) (Success *bool, err error)
+	Validate(txid string, reads []ReadVersion) (Success *bool, err error)
+	Locks() (Locks []LockInfo, err error)
+	Bootstrap(snapshot *SnapshotResult) (err error)
+	MerkleTree() (Tree *merkle.Tree, err error)
+	MerkleBucket(bucket int) (Keys []KeyDigest, err error)
+	LatestVersion(key string) (Version *KeyVersion, err error)
+	Repair(v *KeyVersion) (Success *bool, err error)
+	Rebuild(snapshot *SnapshotResult) (Incarnation *string, err error)
 }
 
 type ReplicaClient struct {
-	host      string
+	host string
+	// mu guards rpcClient, which Reconnect and failed calls drop while
+	// other calls may be using it.
+	mu        sync.Mutex
 	rpcClient *rpc.Client
 }
 
 func NewReplicaClient(host string) *ReplicaClient {
-	client := &ReplicaClient{host, nil}
+	client := &ReplicaClient{host: host}
 	_ = client.tryConnect()
 	return client
 }
 
 func (c *ReplicaClient) tryConnect() (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	if c.rpcClient != nil {
 		return
 	}
@@ -41,13 +65,30 @@ func (c *ReplicaClient) tryConnect() (err error) {
 	return
 }
 
+func (c *ReplicaClient) Host() string {
+	return c.host
+}
+
+// Reconnect drops the current connection, for when the replica is known to
+// have restarted. The next call dials again.
+func (c *ReplicaClient) Reconnect() {
+	c.mu.Lock()
+	rpcClient := c.rpcClient
+	c.rpcClient = nil
+	c.mu.Unlock()
+
+	if rpcClient != nil {
+		_ = rpcClient.Close()
+	}
+}
+
 func (c *ReplicaClient) TryPut(key string, value string, txid string, die common.ReplicaDeath) (Success *bool, err error) {
 	if err = c.tryConnect(); err != nil {
 		return
 	}
 
 	var reply ReplicaActionResult
-	err = c.call("Replica.TryPut", &TxPutArgs{key, value, txid, die}, &reply)
+	err = c.call("Replica.TryPut", &TxPutArgs{key, value, txid, die, nil, ""}, &reply)
 	if err != nil {
 		log.Println("ReplicaClient.TryPut:", err)
 		return
@@ -75,13 +116,31 @@ func (c *ReplicaClient) Get(key string) (Value *string, err error) {
 	return
 }
 
+// TxGet reads key in a locking tx, or as of snapshot if it is set.
+func (c *ReplicaClient) TxGet(key string, txid string, snapshot string) (Result *TxGetResult, err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply TxGetResult
+	err = c.call("Replica.TxGet", &TxGetArgs{key, txid, snapshot}, &reply)
+	if err != nil {
+		log.Println("ReplicaClient.TxGet:", err)
+		return
+	}
+
+	Result = &reply
+
+	return
+}
+
 func (c *ReplicaClient) TryDel(key string, txid string, die common.ReplicaDeath) (Success *bool, err error) {
 	if err = c.tryConnect(); err != nil {
 		return
 	}
 
 	var reply ReplicaActionResult
-	err = c.call("Replica.TryDel", &TxDelArgs{key, txid, die}, &reply)
+	err = c.call("Replica.TryDel", &TxDelArgs{key, txid, die, nil, ""}, &reply)
 	if err != nil {
 		log.Println("ReplicaClient.TryDel:", err)
 		return
@@ -93,13 +152,13 @@ func (c *ReplicaClient) TryDel(key string, txid string, die common.ReplicaDeath)
 }
 
 // Commit This is called via RPC by the Master to ask the Replica to commit a transaction.
-func (c *ReplicaClient) Commit(txid string, die common.ReplicaDeath) (Success *bool, err error) {
+func (c *ReplicaClient) Commit(txid string, commitTs string, die common.ReplicaDeath) (Success *bool, err error) {
 	if err = c.tryConnect(); err != nil {
 		return
 	}
 
 	var reply ReplicaActionResult
-	err = c.call("Replica.Commit", &CommitArgs{txid, die}, &reply)
+	err = c.call("Replica.Commit", &CommitArgs{txid, commitTs, die}, &reply)
 	if err != nil {
 		log.Println("ReplicaClient.Commit:", err)
 		return
@@ -125,20 +184,285 @@ func (c *ReplicaClient) Abort(txid string) (Success *bool, err error) {
 	return &reply.Success, nil
 }
 
+func (c *ReplicaClient) Snapshot() (Snapshot *SnapshotResult, err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply SnapshotResult
+	err = c.call("Replica.Snapshot", &SnapshotArgs{}, &reply)
+	if err != nil {
+		log.Println("ReplicaClient.Snapshot:", err)
+		return
+	}
+
+	Snapshot = &reply
+
+	return
+}
+
+// Bootstrap loads the committed data of snapshot into an empty replica.
+func (c *ReplicaClient) Bootstrap(snapshot *SnapshotResult) (err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply int
+	err = c.call("Replica.Bootstrap", &BootstrapArgs{snapshot.Committed, snapshot.Versions}, &reply)
+	if err != nil {
+		log.Println("ReplicaClient.Bootstrap:", err)
+	}
+	return
+}
+
+func (c *ReplicaClient) VersionedGet(key string) (Result *VersionedGetResult, err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply VersionedGetResult
+	err = c.call("Replica.VersionedGet", &ReplicaKeyArgs{key}, &reply)
+	if err != nil {
+		log.Println("ReplicaClient.VersionedGet:", err)
+		return
+	}
+
+	Result = &reply
+
+	return
+}
+
+// TryPutOptimistic prepares a write of an optimistic tx. The replica votes no
+// unless every read in reads is still current.
+func (c *ReplicaClient) TryPutOptimistic(key string, value string, txid string, reads []ReadVersion) (Success *bool, err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply ReplicaActionResult
+	err = c.call("Replica.TryPut", &TxPutArgs{key, value, txid, common.ReplicaDontDie, reads, ""}, &reply)
+	if err != nil {
+		log.Println("ReplicaClient.TryPutOptimistic:", err)
+		return
+	}
+
+	Success = &reply.Success
+
+	return
+}
+
+func (c *ReplicaClient) TryDelOptimistic(key string, txid string, reads []ReadVersion) (Success *bool, err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply ReplicaActionResult
+	err = c.call("Replica.TryDel", &TxDelArgs{key, txid, common.ReplicaDontDie, reads, ""}, &reply)
+	if err != nil {
+		log.Println("ReplicaClient.TryDelOptimistic:", err)
+		return
+	}
+
+	Success = &reply.Success
+
+	return
+}
+
+// TryPutSnapshot prepares a write of a snapshot tx. The replica votes no if
+// the key was committed since snapshot, the tx's start.
+func (c *ReplicaClient) TryPutSnapshot(key string, value string, txid string, snapshot string) (Success *bool, err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply ReplicaActionResult
+	err = c.call("Replica.TryPut", &TxPutArgs{key, value, txid, common.ReplicaDontDie, nil, snapshot}, &reply)
+	if err != nil {
+		log.Println("ReplicaClient.TryPutSnapshot:", err)
+		return
+	}
+
+	Success = &reply.Success
+
+	return
+}
+
+func (c *ReplicaClient) TryDelSnapshot(key string, txid string, snapshot string) (Success *bool, err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply ReplicaActionResult
+	err = c.call("Replica.TryDel", &TxDelArgs{key, txid, common.ReplicaDontDie, nil, snapshot}, &reply)
+	if err != nil {
+		log.Println("ReplicaClient.TryDelSnapshot:", err)
+		return
+	}
+
+	Success = &reply.Success
+
+	return
+}
+
+// Validate prepares an optimistic tx that writes nothing, by checking its
+// reads alone.
+func (c *ReplicaClient) Validate(txid string, reads []ReadVersion) (Success *bool, err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply ReplicaActionResult
+	err = c.call("Replica.TryValidate", &ValidateArgs{txid, reads}, &reply)
+	if err != nil {
+		log.Println("ReplicaClient.Validate:", err)
+		return
+	}
+
+	Success = &reply.Success
+
+	return
+}
+
+func (c *ReplicaClient) RenewLeases(txids []string) (err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply int
+	err = c.call("Replica.RenewLeases", &RenewLeasesArgs{txids}, &reply)
+	if err != nil {
+		log.Println("ReplicaClient.RenewLeases:", err)
+	}
+	return
+}
+
+func (c *ReplicaClient) Locks() (Locks []LockInfo, err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply LocksResult
+	err = c.call("Replica.Locks", &LocksArgs{}, &reply)
+	if err != nil {
+		log.Println("ReplicaClient.Locks:", err)
+		return
+	}
+
+	Locks = reply.Locks
+
+	return
+}
+
+func (c *ReplicaClient) MerkleTree() (Tree *merkle.Tree, err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply MerkleTreeResult
+	err = c.call("Replica.MerkleTree", &MerkleTreeArgs{}, &reply)
+	if err != nil {
+		log.Println("ReplicaClient.MerkleTree:", err)
+		return
+	}
+
+	Tree = &reply.Tree
+
+	return
+}
+
+func (c *ReplicaClient) MerkleBucket(bucket int) (Keys []KeyDigest, err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply MerkleBucketResult
+	err = c.call("Replica.MerkleBucket", &MerkleBucketArgs{bucket}, &reply)
+	if err != nil {
+		log.Println("ReplicaClient.MerkleBucket:", err)
+		return
+	}
+
+	Keys = reply.Keys
+
+	return
+}
+
+func (c *ReplicaClient) LatestVersion(key string) (Version *KeyVersion, err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply KeyVersion
+	err = c.call("Replica.LatestVersion", &ReplicaKeyArgs{key}, &reply)
+	if err != nil {
+		log.Println("ReplicaClient.LatestVersion:", err)
+		return
+	}
+
+	Version = &reply
+
+	return
+}
+
+func (c *ReplicaClient) Repair(v *KeyVersion) (Success *bool, err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply ReplicaActionResult
+	err = c.call("Replica.Repair", v, &reply)
+	if err != nil {
+		log.Println("ReplicaClient.Repair:", err)
+		return
+	}
+
+	Success = &reply.Success
+
+	return
+}
+
+func (c *ReplicaClient) Rebuild(snapshot *SnapshotResult) (Incarnation *string, err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply RebuildResult
+	err = c.call("Replica.Rebuild", snapshot, &reply)
+	if err != nil {
+		log.Println("ReplicaClient.Rebuild:", err)
+		return
+	}
+
+	Incarnation = &reply.Incarnation
+
+	return
+}
+
+// call fails with rpc.ErrShutdown if the connection was dropped since
+// tryConnect, the next call dials again.
 func (c *ReplicaClient) call(serviceMethod string, args interface{}, reply interface{}) (err error) {
-	err = c.rpcClient.Call(serviceMethod, args, reply)
+	c.mu.Lock()
+	rpcClient := c.rpcClient
+	c.mu.Unlock()
+	if rpcClient == nil {
+		return rpc.ErrShutdown
+	}
+
+	err = rpcClient.Call(serviceMethod, args, reply)
 	var opError *net.OpError
 	isNetOpError := errors.As(err, &opError)
 	if errors.Is(err, rpc.ErrShutdown) || isNetOpError {
-		c.rpcClient = nil
+		c.mu.Lock()
+		// Unless someone replaced it already
+		if c.rpcClient == rpcClient {
+			c.rpcClient = nil
+		}
+		c.mu.Unlock()
+		_ = rpcClient.Close()
 	}
 	return
 }
 
-func GetReplicaHost(replicaNum int) string {
-	return fmt.Sprintf("localhost:%v", common.ReplicaPortStart+replicaNum)
-}
-
 //----------------------------------------------------------------------
 
 type ReplicaKeyArgs struct {
@@ -149,26 +473,153 @@ type ReplicaGetResult struct {
 	Value string
 }
 
+// TxGetArgs reads as of Snapshot, a timestamp, without locking when it is
+// set.
+type TxGetArgs struct {
+	Key      string
+	TxId     string
+	Snapshot string
+}
+
+// TxGetResult is Success false when the read lock couldn't be taken, which
+// dooms the tx.
+type TxGetResult struct {
+	Value   string
+	Found   bool
+	Success bool
+	// Version is the commit timestamp of the value read, for snapshot reads.
+	Version string
+}
+
+// TxPutArgs carries the read set of an optimistic tx in Reads, and the start
+// of a snapshot tx in Snapshot. Both are empty for locking txs.
 type TxPutArgs struct {
-	Key   string
-	Value string
-	TxId  string
-	Die   common.ReplicaDeath
+	Key      string
+	Value    string
+	TxId     string
+	Die      common.ReplicaDeath
+	Reads    []ReadVersion
+	Snapshot string
 }
 
 type TxDelArgs struct {
-	Key  string
-	TxId string
-	Die  common.ReplicaDeath
+	Key      string
+	TxId     string
+	Die      common.ReplicaDeath
+	Reads    []ReadVersion
+	Snapshot string
 }
 type ReplicaActionResult struct {
 	Success bool
 }
 type CommitArgs struct {
-	TxId string
-	Die  common.ReplicaDeath
+	TxId     string
+	CommitTs string
+	Die      common.ReplicaDeath
 }
 
 type AbortArgs struct {
 	TxId string
 }
+
+// ReadVersion is a key an optimistic tx read and the version it saw. The
+// version is the commit timestamp of the value, or empty if the key was never
+// written since versions were kept.
+type ReadVersion struct {
+	Key     string
+	Version string
+}
+
+type VersionedGetResult struct {
+	Value   string
+	Found   bool
+	Version string
+}
+
+type ValidateArgs struct {
+	TxId  string
+	Reads []ReadVersion
+}
+
+type SnapshotArgs struct {
+}
+
+// SnapshotResult is a consistent image of a replica: both stores as they were
+// when the log ended at LogPosition, and the log up to that point.
+type SnapshotResult struct {
+	Committed   map[string]string
+	Temp        map[string]string
+	Versions    map[string]string
+	Log         []byte
+	LogPosition int64
+}
+
+// BootstrapArgs holds the committed data of another replica, as stored.
+type BootstrapArgs struct {
+	Committed map[string]string
+	Versions  map[string]string
+}
+
+type MerkleTreeArgs struct {
+}
+
+type MerkleTreeResult struct {
+	Tree merkle.Tree
+}
+
+type MerkleBucketArgs struct {
+	Bucket int
+}
+
+// KeyDigest sums up the latest committed version of a key. CommitTs is "" for
+// a key not written since versions were kept.
+type KeyDigest struct {
+	Key       string
+	CommitTs  string
+	Deleted   bool
+	ValueHash []byte
+}
+
+type MerkleBucketResult struct {
+	Keys []KeyDigest
+}
+
+// KeyVersion is the latest committed version of a key, sent to replicas that
+// missed it.
+type KeyVersion struct {
+	Key      string
+	CommitTs string
+	Value    string
+	Deleted  bool
+	Found    bool
+}
+
+type RebuildResult struct {
+	Incarnation string
+}
+
+// RenewLeasesArgs lists the txs the master is still working on.
+type RenewLeasesArgs struct {
+	TxIds []string
+}
+
+type LocksArgs struct {
+}
+
+// LockInfo is a lock held or waited for. Replica is -1 for the namespace and
+// table locks kept by the master.
+type LockInfo struct {
+	Replica int
+	TxId    string
+	Key     string
+	Mode    string
+	State   common.TxState
+	Waiting bool
+	Age     time.Duration
+}
+
+// LocksResult lists Unreachable replicas whose locks are missing.
+type LocksResult struct {
+	Locks       []LockInfo
+	Unreachable []int
+}
@@ -0,0 +1,125 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ClusterConfig says where every node runs and keeps its files. It is read
+// from a JSON file such as:
+//
+//	{
+//	  "master": {"listen": ":7170", "advertise": "db1:7170", "logDir": "/var/lib/twopc/logs"},
+//	  "replicas": [
+//	    {"id": 0, "listen": ":7171", "advertise": "db2:7171", "dataDir": "/var/lib/twopc/data", "logDir": "/var/lib/twopc/logs"},
+//	    {"id": 1, "listen": ":7171", "advertise": "db3:7171", "group": 1}
+//	  ]
+//	}
+//
+// Listen is the address a node binds to, advertise the one others dial;
+// either defaults to the other. Directories default to the layout used
+// without a config file. Replicas with the same group hold the same shard of
+// the keys; all of them are in group 0 unless told otherwise.
+type ClusterConfig struct {
+	Master   NodeConfig   `json:"master"`
+	Replicas []NodeConfig `json:"replicas"`
+}
+
+type NodeConfig struct {
+	Id        int    `json:"id"`
+	Listen    string `json:"listen"`
+	Advertise string `json:"advertise"`
+	DataDir   string `json:"dataDir"`
+	LogDir    string `json:"logDir"`
+	Group     int    `json:"group"`
+}
+
+// DefaultClusterConfig is the single host cluster on fixed localhost ports.
+func DefaultClusterConfig(replicaCount int) *ClusterConfig {
+	c := &ClusterConfig{Master: NodeConfig{Advertise: MasterPort}}
+	for i := 0; i < replicaCount; i++ {
+		c.Replicas = append(c.Replicas, NodeConfig{Id: i, Advertise: fmt.Sprintf("localhost:%v", ReplicaPortStart+i)})
+	}
+	c.setDefaults()
+	return c
+}
+
+// SplitGroups spreads the replicas over groupCount groups, round robin.
+func (c *ClusterConfig) SplitGroups(groupCount int) {
+	for i := range c.Replicas {
+		c.Replicas[i].Group = i % groupCount
+	}
+}
+
+func LoadClusterConfig(configPath string) (c *ClusterConfig, err error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return
+	}
+	c = &ClusterConfig{}
+	err = json.Unmarshal(data, c)
+	if err != nil {
+		return nil, errors.New(fmt.Sprint("Malformed cluster config ", configPath, ": ", err))
+	}
+	err = c.validate()
+	if err != nil {
+		return nil, errors.New(fmt.Sprint("Invalid cluster config ", configPath, ": ", err))
+	}
+	c.setDefaults()
+	return
+}
+
+// Replica returns the node of replica id.
+func (c *ClusterConfig) Replica(id int) (node NodeConfig, err error) {
+	if id < 0 || id >= len(c.Replicas) {
+		return node, errors.New(fmt.Sprint("No replica ", id, " in cluster config"))
+	}
+	return c.Replicas[id], nil
+}
+
+// validate requires replicas to be listed by id, starting at 0, and every node
+// to have an address.
+func (c *ClusterConfig) validate() error {
+	if c.Master.Listen == "" && c.Master.Advertise == "" {
+		return errors.New("master has no address")
+	}
+	if len(c.Replicas) == 0 {
+		return errors.New("no replicas")
+	}
+	for i, r := range c.Replicas {
+		if r.Id != i {
+			return errors.New(fmt.Sprint("replica ", r.Id, " listed as number ", i, ", replicas must be listed by id from 0"))
+		}
+		if r.Listen == "" && r.Advertise == "" {
+			return errors.New(fmt.Sprint("replica ", r.Id, " has no address"))
+		}
+		if r.Group < 0 {
+			return errors.New(fmt.Sprint("replica ", r.Id, " has negative group ", r.Group))
+		}
+	}
+	return nil
+}
+
+func (c *ClusterConfig) setDefaults() {
+	c.Master.setDefaults("")
+	for i := range c.Replicas {
+		c.Replicas[i].setDefaults(fmt.Sprintf("data/replica%v", c.Replicas[i].Id))
+	}
+}
+
+func (n *NodeConfig) setDefaults(dataDir string) {
+	if n.Listen == "" {
+		n.Listen = n.Advertise
+	}
+	if n.Advertise == "" {
+		n.Advertise = n.Listen
+	}
+	if n.DataDir == "" {
+		n.DataDir = dataDir
+	}
+	if n.LogDir == "" {
+		n.LogDir = "logs"
+	}
+}
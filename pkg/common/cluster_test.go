@@ -0,0 +1,50 @@
+package common
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadClusterConfig(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "cluster.json")
+	err := os.WriteFile(configPath, []byte(`{
+		"master": {"listen": ":7170", "advertise": "db1:7170"},
+		"replicas": [
+			{"id": 0, "advertise": "db2:7171", "dataDir": "/srv/data"},
+			{"id": 1, "listen": "db3:7171", "group": 1}
+		]
+	}`), 0644)
+	assert.Nil(t, err)
+
+	c, err := LoadClusterConfig(configPath)
+	assert.Nil(t, err)
+	assert.Equal(t, NodeConfig{Listen: ":7170", Advertise: "db1:7170", LogDir: "logs"}, c.Master)
+	assert.Equal(t, NodeConfig{Id: 0, Listen: "db2:7171", Advertise: "db2:7171", DataDir: "/srv/data", LogDir: "logs"}, c.Replicas[0])
+	assert.Equal(t, NodeConfig{Id: 1, Listen: "db3:7171", Advertise: "db3:7171", DataDir: "data/replica1", LogDir: "logs", Group: 1}, c.Replicas[1])
+
+	_, err = c.Replica(2)
+	assert.NotNil(t, err)
+}
+
+func TestLoadClusterConfigRejectsGaps(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "cluster.json")
+	err := os.WriteFile(configPath, []byte(`{"master": {"listen": ":7170"}, "replicas": [{"id": 1, "listen": ":7171"}]}`), 0644)
+	assert.Nil(t, err)
+
+	_, err = LoadClusterConfig(configPath)
+	assert.NotNil(t, err)
+}
+
+func TestDefaultClusterConfig(t *testing.T) {
+	c := DefaultClusterConfig(2)
+	assert.Equal(t, "localhost:7170", c.Master.Listen)
+	assert.Equal(t, "localhost:7172", c.Replicas[1].Advertise)
+	assert.Equal(t, "data/replica1", c.Replicas[1].DataDir)
+	assert.Equal(t, 0, c.Replicas[1].Group)
+
+	c = DefaultClusterConfig(5)
+	c.SplitGroups(2)
+	assert.Equal(t, []int{0, 1, 0, 1, 0}, []int{c.Replicas[0].Group, c.Replicas[1].Group, c.Replicas[2].Group, c.Replicas[3].Group, c.Replicas[4].Group})
+}
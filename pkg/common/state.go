@@ -1,5 +1,7 @@
 package common
 
+import "errors"
+
 type Operation int
 
 const (
@@ -22,7 +24,6 @@ func (s Operation) String() string {
 	default:
 		panic("unhandled default case")
 	}
-	return "INVALID"
 }
 
 func ParseOperation(s string) Operation {
@@ -39,6 +40,58 @@ func ParseOperation(s string) Operation {
 
 // ----------------------------------------------------------------------
 
+// TxOlder reports whether tx a started before tx b. The master names txs after
+// their start time in nanoseconds, so a shorter id is older.
+func TxOlder(a string, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// ----------------------------------------------------------------------
+
+// Isolation is how an interactive tx is kept apart from concurrent ones.
+type Isolation int
+
+const (
+	// Locking holds read and write locks until the tx ends (strict 2PL).
+	Locking Isolation = iota
+	// Snapshot reads from the state as of the tx's start without locking.
+	// Of two concurrent txs writing the same key, the first to commit wins.
+	Snapshot
+	// SerializableSnapshot is Snapshot plus a check at commit that nothing
+	// the tx read was overwritten since, which rules out write skew.
+	SerializableSnapshot
+)
+
+func (i Isolation) String() string {
+	switch i {
+	case Locking:
+		return "locking"
+	case Snapshot:
+		return "snapshot"
+	case SerializableSnapshot:
+		return "serializable-snapshot"
+	default:
+		panic("unhandled default case")
+	}
+}
+
+func ParseIsolation(s string) (Isolation, error) {
+	switch s {
+	case "locking":
+		return Locking, nil
+	case "snapshot":
+		return Snapshot, nil
+	case "serializable-snapshot":
+		return SerializableSnapshot, nil
+	}
+	return Locking, errors.New("unknown isolation level: " + s)
+}
+
+// ----------------------------------------------------------------------
+
 type TxState int
 
 const (
@@ -51,6 +104,8 @@ const (
 
 func (s TxState) String() string {
 	switch s {
+	case NoState:
+		return "NOSTATE"
 	case Started:
 		return "STARTED"
 	case Prepared:
@@ -62,7 +117,6 @@ func (s TxState) String() string {
 	default:
 		panic("unhandled default case")
 	}
-	return "INVALID"
 }
 func ParseTxState(s string) TxState {
 	switch s {
@@ -82,7 +136,36 @@ func ParseTxState(s string) TxState {
 
 type Tx struct {
 	Id    string
-	Key   string
-	Op    Operation
 	State TxState
+	// Ops holds the writes of the tx, at most one per key.
+	Ops []TxOp
+}
+
+type TxOp struct {
+	Op  Operation
+	Key string
+}
+
+// SetOp records op on key, replacing an earlier write to the same key. It
+// returns the write it replaced, or NoOp.
+func (tx *Tx) SetOp(op Operation, key string) (replaced Operation) {
+	for i := range tx.Ops {
+		if tx.Ops[i].Key == key {
+			replaced = tx.Ops[i].Op
+			tx.Ops[i].Op = op
+			return
+		}
+	}
+	tx.Ops = append(tx.Ops, TxOp{Op: op, Key: key})
+	return NoOp
+}
+
+// GetOp returns the write the tx made to key, or NoOp.
+func (tx *Tx) GetOp(key string) Operation {
+	for _, o := range tx.Ops {
+		if o.Key == key {
+			return o.Op
+		}
+	}
+	return NoOp
 }
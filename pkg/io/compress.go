@@ -0,0 +1,117 @@
+package io
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	goio "io"
+	"strings"
+)
+
+var (
+	CompressFormatError = errors.New("value is compressed in an unknown format")
+)
+
+// An encoded value starts with compressMagic and a format byte. UTF-8 text
+// never holds the 0xff of the magic, so values stored plain, such as those
+// written before compression was turned on, are told apart and returned as
+// they are.
+const (
+	compressMagic      = "\x00\xffzv"
+	rawFormat     byte = 0x00
+	gzipFormat    byte = 0x01
+
+	// compressMinSize is the smallest value worth running through gzip.
+	compressMinSize = 128
+)
+
+// CompressedStore decodes the values of the wrapped store and, if compress is
+// set, gzips values on their way in, keeping the raw form whenever compression
+// doesn't pay off. Without compress values are stored as they are, so a store
+// can hold both kinds and compression can be turned on or off at any time.
+type CompressedStore struct {
+	store    IKeyValueStore
+	compress bool
+}
+
+func NewCompressedStore(store IKeyValueStore, compress bool) *CompressedStore {
+	return &CompressedStore{store, compress}
+}
+
+func (s *CompressedStore) Put(key string, value string) (err error) {
+	encoded := []byte(value)
+	if s.compress || strings.HasPrefix(value, compressMagic) {
+		// A plain value that looks encoded gets encoded, or it would be
+		// misread
+		encoded, err = compressValue(encoded, s.compress)
+		if err != nil {
+			return
+		}
+	}
+	return s.store.Put(key, string(encoded))
+}
+
+func (s *CompressedStore) Del(key string) (err error) {
+	return s.store.Del(key)
+}
+
+func (s *CompressedStore) Get(key string) (value string, err error) {
+	encoded, err := s.store.Get(key)
+	if err != nil {
+		return
+	}
+	decoded, err := decompressValue([]byte(encoded))
+	if err != nil {
+		return
+	}
+	return string(decoded), nil
+}
+
+func (s *CompressedStore) List() (keys []string, err error) {
+	return s.store.List()
+}
+
+func (s *CompressedStore) Unwrap() IKeyValueStore {
+	return s.store
+}
+
+func compressValue(value []byte, compress bool) (encoded []byte, err error) {
+	if compress && len(value) >= compressMinSize {
+		var buf bytes.Buffer
+		buf.WriteString(compressMagic)
+		buf.WriteByte(gzipFormat)
+		w := gzip.NewWriter(&buf)
+		if _, err = w.Write(value); err != nil {
+			return
+		}
+		if err = w.Close(); err != nil {
+			return
+		}
+		if buf.Len() < len(value)+len(compressMagic)+1 {
+			return buf.Bytes(), nil
+		}
+	}
+	encoded = append([]byte(compressMagic), rawFormat)
+	return append(encoded, value...), nil
+}
+
+func decompressValue(encoded []byte) (value []byte, err error) {
+	if !bytes.HasPrefix(encoded, []byte(compressMagic)) || len(encoded) == len(compressMagic) {
+		return encoded, nil
+	}
+	body := encoded[len(compressMagic)+1:]
+	switch encoded[len(compressMagic)] {
+	case rawFormat:
+		return body, nil
+	case gzipFormat:
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return goio.ReadAll(r)
+	default:
+		return nil, errors.New(fmt.Sprint(CompressFormatError, ": ", encoded[len(compressMagic)]))
+	}
+}
@@ -0,0 +1,44 @@
+package io
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestCompressedStoreMixesFormats(t *testing.T) {
+	base := NewKeyValueStore(t.TempDir())
+	store := NewCompressedStore(base, true)
+
+	big := strings.Repeat(`{"name":"alice","role":"admin"},`, 100)
+	assert.Nil(t, store.Put("big", big))
+	assert.Nil(t, store.Put("small", "bob"))
+	// Written before compression was turned on.
+	assert.Nil(t, base.Put("legacy", "carol"))
+	assert.Nil(t, base.Put("binary", "\x01\x00"))
+
+	raw, err := base.Get("big")
+	assert.Nil(t, err)
+	assert.Equal(t, compressMagic+string(gzipFormat), raw[:len(compressMagic)+1])
+	assert.Less(t, len(raw), len(big))
+
+	raw, err = base.Get("small")
+	assert.Nil(t, err)
+	assert.Equal(t, compressMagic+string(rawFormat)+"bob", raw)
+
+	// Turned off again, new values are stored plain and old ones still read.
+	store = NewCompressedStore(base, false)
+	assert.Nil(t, store.Put("plain", "dave"))
+	assert.Nil(t, store.Put("lookalike", compressMagic+"x"))
+	raw, err = base.Get("plain")
+	assert.Nil(t, err)
+	assert.Equal(t, "dave", raw)
+
+	for key, want := range map[string]string{
+		"big": big, "small": "bob", "legacy": "carol", "binary": "\x01\x00", "plain": "dave", "lookalike": compressMagic + "x",
+	} {
+		val, err := store.Get(key)
+		assert.Nil(t, err)
+		assert.Equal(t, want, val)
+	}
+}
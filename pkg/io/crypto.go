@@ -0,0 +1,427 @@
+package io
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	goio "io"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"twopc/pkg/common"
+)
+
+var (
+	UnknownKeyError   = errors.New("value is encrypted with a key missing from the key file")
+	ShortCipherError  = errors.New("encrypted value is too short")
+	EmptyKeyringError = errors.New("key file holds no keys")
+	PlaintextError    = errors.New("store holds data that isn't encrypted")
+)
+
+// Keyring holds the AES keys read from a key file. Every line of the file is
+// "<id> <hex key>" with id in 1..255 and a 16, 24 or 32 byte key. The last key
+// encrypts new data; older keys are only used to decrypt, so to rotate append
+// a new key and keep the old ones until nothing references them.
+type Keyring struct {
+	active byte
+	aeads  map[byte]cipher.AEAD
+	// nameKeys derive the nonces of sealed names, one per key.
+	nameKeys map[byte][]byte
+}
+
+func LoadKeyring(keyFilePath string) (keyring *Keyring, err error) {
+	file, err := os.Open(keyFilePath)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	keyring = &Keyring{aeads: make(map[byte]cipher.AEAD), nameKeys: make(map[byte][]byte)}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errors.New(fmt.Sprint("Malformed key file line: ", line))
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 8)
+		if err != nil || id == 0 {
+			return nil, errors.New(fmt.Sprint("Invalid key id: ", fields[0]))
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, errors.New(fmt.Sprint("Invalid key for id ", id, ": ", err))
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, errors.New(fmt.Sprint("Invalid key for id ", id, ": ", err))
+		}
+		keyring.aeads[byte(id)] = aead
+		keyring.nameKeys[byte(id)] = mac(key, []byte("file names"))
+		keyring.active = byte(id)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if keyring.active == 0 {
+		return nil, EmptyKeyringError
+	}
+	return
+}
+
+func newAEAD(key []byte) (aead cipher.AEAD, err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal encrypts plain with the active key. The result is the key id, the nonce
+// and the sealed data.
+func (k *Keyring) Seal(plain []byte) (sealed []byte, err error) {
+	aead := k.aeads[k.active]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = goio.ReadFull(rand.Reader, nonce); err != nil {
+		return
+	}
+	sealed = append([]byte{k.active}, nonce...)
+	return aead.Seal(sealed, nonce, plain, []byte{k.active}), nil
+}
+
+func (k *Keyring) Open(sealed []byte) (plain []byte, err error) {
+	if len(sealed) < 1 {
+		return nil, ShortCipherError
+	}
+	aead, ok := k.aeads[sealed[0]]
+	if !ok {
+		return nil, UnknownKeyError
+	}
+	if len(sealed) < 1+aead.NonceSize() {
+		return nil, ShortCipherError
+	}
+	nonce := sealed[1 : 1+aead.NonceSize()]
+	return aead.Open(nil, nonce, sealed[1+aead.NonceSize():], sealed[:1])
+}
+
+// SealName encrypts name with the key id so that it can name a file. Unlike
+// Seal the result only depends on name and key: the nonce is derived from the
+// name, so the same name can be looked up again. That shows which files have
+// the same name, nothing more.
+func (k *Keyring) SealName(id byte, name string) string {
+	aead := k.aeads[id]
+	nonce := mac(k.nameKeys[id], []byte(name))[:aead.NonceSize()]
+	sealed := append([]byte{id}, nonce...)
+	sealed = aead.Seal(sealed, nonce, []byte(name), []byte{id})
+	return base64.RawURLEncoding.EncodeToString(sealed)
+}
+
+// OpenName decrypts a name sealed by SealName and returns the id of the key it
+// was sealed with.
+func (k *Keyring) OpenName(sealed string) (name string, id byte, err error) {
+	data, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil || len(data) < sealedNameSize {
+		// Can't be one of ours, whatever its first byte says
+		return "", 0, ShortCipherError
+	}
+	plain, err := k.Open(data)
+	if err != nil {
+		return
+	}
+	return string(plain), data[0], nil
+}
+
+// sealedNameSize is how long a sealed empty name is: the key id, the nonce and
+// the GCM tag.
+const sealedNameSize = 1 + 12 + 16
+
+// ids returns the key ids, the active one first.
+func (k *Keyring) ids() (ids []byte) {
+	ids = append(ids, k.active)
+	for id := range k.aeads {
+		if id != k.active {
+			ids = append(ids, id)
+		}
+	}
+	return
+}
+
+func mac(key []byte, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// ----------------------------------------------------------------------
+
+// EncryptedStore encrypts keys and values on their way into the wrapped
+// store. Keys name the files, so they are sealed with SealName: a key is found
+// under the name the active key gives it, or the one an older key gave it
+// before it was rotated.
+type EncryptedStore struct {
+	store   IKeyValueStore
+	keyring *Keyring
+}
+
+func NewEncryptedStore(store IKeyValueStore, keyring *Keyring) *EncryptedStore {
+	return &EncryptedStore{store, keyring}
+}
+
+func (s *EncryptedStore) Put(key string, value string) (err error) {
+	sealed, err := s.keyring.Seal([]byte(value))
+	if err != nil {
+		return
+	}
+	err = s.store.Put(s.keyring.SealName(s.keyring.active, key), string(sealed))
+	if err != nil {
+		return
+	}
+	// Drop what an older key left, Get would no longer see it anyway
+	for _, id := range s.keyring.ids()[1:] {
+		err = s.store.Del(s.keyring.SealName(id, key))
+		if err != nil {
+			return
+		}
+	}
+	return nil
+}
+
+func (s *EncryptedStore) Del(key string) (err error) {
+	for _, id := range s.keyring.ids() {
+		err = s.store.Del(s.keyring.SealName(id, key))
+		if err != nil {
+			return
+		}
+	}
+	return nil
+}
+
+func (s *EncryptedStore) Get(key string) (value string, err error) {
+	for _, id := range s.keyring.ids() {
+		value, err = s.open(s.keyring.SealName(id, key), key)
+		if !errors.Is(err, fs.ErrNotExist) {
+			return
+		}
+	}
+	return
+}
+
+// open reads and decrypts the value in the file name, which holds key.
+func (s *EncryptedStore) open(name string, key string) (value string, err error) {
+	sealed, err := s.store.Get(name)
+	if err != nil {
+		return
+	}
+	plain, err := s.keyring.Open([]byte(sealed))
+	if err != nil {
+		return "", errors.New(fmt.Sprint("Unable to decrypt key ", key, ": ", err))
+	}
+	return string(plain), nil
+}
+
+func (s *EncryptedStore) List() (keys []string, err error) {
+	names, err := s.store.List()
+	if err != nil {
+		return
+	}
+	keys = make([]string, 0, len(names))
+	for _, name := range names {
+		key, _, err := s.keyring.OpenName(name)
+		if err != nil {
+			return nil, errors.New(fmt.Sprint("Unable to decrypt file name ", name, ": ", err))
+		}
+		keys = append(keys, key)
+	}
+	return
+}
+
+func (s *EncryptedStore) Unwrap() IKeyValueStore {
+	return s.store
+}
+
+// Check fails with PlaintextError if the store holds files whose names aren't
+// encrypted, e.g. because they were written before the key file was given.
+// Rotate encrypts them.
+func (s *EncryptedStore) Check() (err error) {
+	names, err := s.store.List()
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		_, _, err = s.keyring.OpenName(name)
+		if errors.Is(err, UnknownKeyError) {
+			return
+		}
+		if err != nil {
+			return errors.New(fmt.Sprint(PlaintextError, ": ", name))
+		}
+	}
+	return nil
+}
+
+// Rotate re-encrypts every entry that isn't already under the active key and
+// returns how many were rewritten. Entries that aren't encrypted at all, or
+// only their value is, are encrypted as well.
+func (s *EncryptedStore) Rotate() (rotated int, err error) {
+	names, err := s.store.List()
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		key, id, err := s.keyring.OpenName(name)
+		if err == nil && id == s.keyring.active {
+			continue
+		}
+		if errors.Is(err, UnknownKeyError) {
+			return rotated, err
+		}
+		var value string
+		if err == nil {
+			value, err = s.open(name, key)
+		} else {
+			key = name
+			value, err = s.plainValue(name)
+		}
+		if err != nil {
+			return rotated, err
+		}
+		err = s.Put(key, value)
+		if err == nil && key == name {
+			err = s.store.Del(name)
+		}
+		if err != nil {
+			return rotated, err
+		}
+		rotated++
+	}
+	return
+}
+
+// plainValue reads the value of a file whose name isn't encrypted. Its value
+// may be, as values were encrypted before names were.
+func (s *EncryptedStore) plainValue(name string) (value string, err error) {
+	value, err = s.store.Get(name)
+	if err != nil {
+		return
+	}
+	if plain, err := s.keyring.Open([]byte(value)); err == nil {
+		return string(plain), nil
+	}
+	return value, nil
+}
+
+// ----------------------------------------------------------------------
+
+// EncryptedLogger encrypts the key column of every log record. The other
+// columns are tx ids and states, which recovery needs and reveal no data.
+type EncryptedLogger struct {
+	ILogger
+	keyring *Keyring
+}
+
+func NewEncryptedLogger(logger ILogger, keyring *Keyring) *EncryptedLogger {
+	return &EncryptedLogger{logger, keyring}
+}
+
+func (l *EncryptedLogger) WriteOp(txId string, state common.TxState, op common.Operation, key string) (err error) {
+	if key != "" {
+		sealed, err := l.keyring.Seal([]byte(key))
+		if err != nil {
+			return err
+		}
+		key = base64.StdEncoding.EncodeToString(sealed)
+	}
+	return l.ILogger.WriteOp(txId, state, op, key)
+}
+
+func (l *EncryptedLogger) Read() (entries []logEntry, err error) {
+	entries, err = l.ILogger.Read()
+	if err != nil {
+		return
+	}
+	for i := range entries {
+		if entries[i].Key == "" {
+			continue
+		}
+		sealed, err := base64.StdEncoding.DecodeString(entries[i].Key)
+		if err != nil {
+			return nil, errors.New(fmt.Sprint("Unable to decode log key of tx ", entries[i].TxId, ": ", err))
+		}
+		plain, err := l.keyring.Open(sealed)
+		if err != nil {
+			return nil, errors.New(fmt.Sprint("Unable to decrypt log key of tx ", entries[i].TxId, ": ", err))
+		}
+		entries[i].Key = string(plain)
+	}
+	return
+}
+
+// RotateLog rewrites the log at path with every key sealed by the active key,
+// including the keys logged before encryption was turned on, and returns how
+// many records changed. The log must not be in use.
+func RotateLog(path string, keyring *Keyring) (rotated int, err error) {
+	entries, err := (&Logger{path: path}).Read()
+	if err != nil || len(entries) == 0 {
+		return
+	}
+	records := make([][]string, len(entries))
+	for i, e := range entries {
+		key := e.Key
+		if key != "" {
+			sealed, err := base64.StdEncoding.DecodeString(key)
+			plain, openErr := keyring.Open(sealed)
+			switch {
+			case err == nil && openErr == nil && sealed[0] == keyring.active:
+			case errors.Is(openErr, UnknownKeyError) && err == nil && len(sealed) >= sealedNameSize:
+				return 0, errors.New(fmt.Sprint("Unable to decrypt log key of tx ", e.TxId, ": ", openErr))
+			default:
+				if err != nil || openErr != nil {
+					// Logged before encryption was turned on
+					plain = []byte(key)
+				}
+				sealed, err = keyring.Seal(plain)
+				if err != nil {
+					return 0, err
+				}
+				key = base64.StdEncoding.EncodeToString(sealed)
+				rotated++
+			}
+		}
+		records[i] = []string{e.TxId, e.State.String(), e.Op.String(), key}
+	}
+	if rotated == 0 {
+		return
+	}
+
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	err = csv.NewWriter(file).WriteAll(records)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return
+}
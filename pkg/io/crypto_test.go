@@ -0,0 +1,115 @@
+package io
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"twopc/pkg/common"
+)
+
+const (
+	testKey1 = "000102030405060708090a0b0c0d0e0f000102030405060708090a0b0c0d0e0f"
+	testKey2 = "f0f1f2f3f4f5f6f7f8f9fafbfcfdfefff0f1f2f3f4f5f6f7f8f9fafbfcfdfeff"
+)
+
+func writeKeyFile(t *testing.T, lines ...string) string {
+	p := filepath.Join(t.TempDir(), "keys.txt")
+	err := os.WriteFile(p, []byte(strings.Join(lines, "\n")), 0600)
+	assert.Nil(t, err)
+	return p
+}
+
+func TestEncryptedStoreRotation(t *testing.T) {
+	dir := t.TempDir()
+	base := NewKeyValueStore(dir)
+
+	keyring, err := LoadKeyring(writeKeyFile(t, "1 "+testKey1))
+	assert.Nil(t, err)
+	err = NewEncryptedStore(base, keyring).Put("foo", "secret")
+	assert.Nil(t, err)
+
+	names, err := base.List()
+	assert.Nil(t, err)
+	assert.Len(t, names, 1)
+	assert.NotContains(t, names[0], "foo")
+	raw, err := base.Get(names[0])
+	assert.Nil(t, err)
+	assert.NotContains(t, raw, "secret")
+
+	keyring, err = LoadKeyring(writeKeyFile(t, "1 "+testKey1, "2 "+testKey2))
+	assert.Nil(t, err)
+	store := NewEncryptedStore(base, keyring)
+
+	rotated, err := store.Rotate()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, rotated)
+
+	// Only the new key is needed once the store is rotated.
+	keyring, err = LoadKeyring(writeKeyFile(t, "2 "+testKey2))
+	assert.Nil(t, err)
+	store = NewEncryptedStore(base, keyring)
+	val, err := store.Get("foo")
+	assert.Nil(t, err)
+	assert.Equal(t, "secret", val)
+	keys, err := store.List()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"foo"}, keys)
+}
+
+func TestEncryptedStoreRejectsPlaintext(t *testing.T) {
+	base := NewKeyValueStore(t.TempDir())
+	assert.Nil(t, base.Put("plain", "value"))
+
+	keyring, err := LoadKeyring(writeKeyFile(t, "1 "+testKey1))
+	assert.Nil(t, err)
+	store := NewEncryptedStore(base, keyring)
+	assert.ErrorContains(t, store.Check(), PlaintextError.Error())
+
+	rotated, err := store.Rotate()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, rotated)
+	assert.Nil(t, store.Check())
+	val, err := store.Get("plain")
+	assert.Nil(t, err)
+	assert.Equal(t, "value", val)
+}
+
+func TestEncryptedLoggerHidesKeys(t *testing.T) {
+	keyring, err := LoadKeyring(writeKeyFile(t, "1 "+testKey1))
+	assert.Nil(t, err)
+
+	inner := NewLogger(filepath.Join(t.TempDir(), "log.txt"))
+	l := NewEncryptedLogger(inner, keyring)
+	assert.Nil(t, l.WriteOp("1", common.Prepared, common.PutOp, "alice"))
+
+	data, err := l.ReadPrefix(l.Position())
+	assert.Nil(t, err)
+	assert.NotContains(t, string(data), "alice")
+
+	entries, err := l.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, "alice", entries[0].Key)
+}
+
+func TestRotateLogEncryptsPlainKeys(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "log.txt")
+	plain := NewLogger(p)
+	assert.Nil(t, plain.WriteOp("1", common.Prepared, common.PutOp, "alice"))
+	assert.Nil(t, plain.WriteState("1", common.Committed))
+
+	keyring, err := LoadKeyring(writeKeyFile(t, "1 "+testKey1))
+	assert.Nil(t, err)
+	rotated, err := RotateLog(p, keyring)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, rotated)
+
+	data, err := os.ReadFile(p)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(data), "alice")
+	entries, err := NewEncryptedLogger(NewLogger(p), keyring).Read()
+	assert.Nil(t, err)
+	assert.Equal(t, "alice", entries[0].Key)
+	assert.Equal(t, common.Committed, entries[1].State)
+}
@@ -1,11 +1,18 @@
 package io
 
 import (
+	"errors"
 	"log"
 	"os"
 	"path"
+	"strings"
 )
 
+// partialDir holds the values still being written, under the file name of
+// their key. A crash between creating the file and renaming it into place
+// leaves one of these behind. No key escapes to it, see escapedMarker.
+const partialDir = "%partial"
+
 type IKeyValueStore interface {
 	Put(key string, value string) (err error)
 	Del(key string) (err error)
@@ -13,31 +20,107 @@ type IKeyValueStore interface {
 	List() (keys []string, err error)
 }
 
+// BaseStore strips every wrapper off store and returns the store that holds
+// the bytes as they are on disk.
+func BaseStore(store IKeyValueStore) IKeyValueStore {
+	for {
+		wrapper, ok := store.(interface{ Unwrap() IKeyValueStore })
+		if !ok {
+			return store
+		}
+		store = wrapper.Unwrap()
+	}
+}
+
 type KeyValueStore struct {
 	basePath string
 }
 
 func NewKeyValueStore(dbPath string) (store *KeyValueStore) {
-	err := os.MkdirAll(dbPath, 0777)
+	err := os.MkdirAll(path.Join(dbPath, partialDir), 0777)
 	if err != nil {
 		log.Fatalln("newKeyValueStore:", err)
 	}
 	store = &KeyValueStore{dbPath}
+	err = store.removePartials()
+	if err != nil {
+		log.Fatalln("newKeyValueStore:", err)
+	}
+	err = store.migrateNames()
+	if err != nil {
+		log.Fatalln("newKeyValueStore:", err)
+	}
 	return
 }
 
+// keyEscaper keeps a hierarchical key such as "namespace/table/key" in a
+// single file. Only the separator and the escape character itself are
+// touched, so flat keys without "%" keep the file names they always had.
+var (
+	keyEscaper   = strings.NewReplacer("%", "%25", "/", "%2F")
+	keyUnescaper = strings.NewReplacer("%25", "%", "%2F", "/")
+)
+
+// escapedMarker is present in a store once its file names are escaped. Names
+// from before that are the keys as they are, see migrateNames. No key escapes
+// to it, since "%" is only ever followed by "25" or "2F".
+const escapedMarker = "%keys"
+
+// stagingDir holds the files migrateNames is renaming, and stagedMarker is
+// put in it once they are all there.
+const (
+	stagingDir   = "%staging"
+	stagedMarker = "%staged"
+)
+
 func (s *KeyValueStore) getPath(key string) string {
-	return path.Join(s.basePath, key)
+	return path.Join(s.basePath, keyEscaper.Replace(key))
 }
 
+func unescapeKey(name string) string {
+	return keyUnescaper.Replace(name)
+}
+
+// Put writes the value to a partial file, syncs it, renames it over the key and
+// finally syncs the directory so the rename itself survives a crash.
 func (s *KeyValueStore) Put(key string, value string) (err error) {
-	err = os.WriteFile(s.getPath(key), []byte(value), 0777)
-	return
+	partialPath := path.Join(s.basePath, partialDir, keyEscaper.Replace(key))
+	file, err := os.OpenFile(partialPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0777)
+	if err != nil {
+		return
+	}
+	_, err = file.WriteString(value)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(partialPath)
+		return
+	}
+
+	err = os.Rename(partialPath, s.getPath(key))
+	if err != nil {
+		_ = os.Remove(partialPath)
+		return
+	}
+	return s.syncDir()
 }
 
+// Del removes the key, if it is there, and syncs the directory so the key
+// doesn't come back after a crash.
 func (s *KeyValueStore) Del(key string) (err error) {
-	_ = os.Remove(s.getPath(key))
-	return nil
+	err = os.Remove(s.getPath(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	return s.syncDir()
 }
 
 func (s *KeyValueStore) Get(key string) (value string, err error) {
@@ -54,9 +137,111 @@ func (s *KeyValueStore) List() (keys []string, err error) {
 	if err != nil {
 		return nil, err
 	}
-	keys = make([]string, len(files))
-	for i, file := range files {
-		keys[i] = file.Name()
+	keys = make([]string, 0, len(files))
+	for _, file := range files {
+		if file.IsDir() || file.Name() == escapedMarker {
+			continue
+		}
+		keys = append(keys, unescapeKey(file.Name()))
 	}
 	return keys, nil
 }
+
+func (s *KeyValueStore) syncDir() (err error) {
+	dir, err := os.Open(s.basePath)
+	if err != nil {
+		return
+	}
+	err = dir.Sync()
+	closeErr := dir.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return
+}
+
+// removePartials deletes values left half-written by a crash. The previous
+// value of the key, if any, is still intact since the rename never happened.
+func (s *KeyValueStore) removePartials() (err error) {
+	partials := path.Join(s.basePath, partialDir)
+	files, err := os.ReadDir(partials)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		log.Println("Removing partially written value", file.Name())
+		err = os.Remove(path.Join(partials, file.Name()))
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// migrateNames escapes the file names of a store written before keys were
+// escaped, where a name is the key itself, and marks the store as escaped.
+// Renamed files go through a staging directory, first all of them in, then
+// all out, so no name is taken twice and a crash halfway can be resumed.
+func (s *KeyValueStore) migrateNames() (err error) {
+	if _, err = os.Stat(path.Join(s.basePath, escapedMarker)); err == nil || !os.IsNotExist(err) {
+		return
+	}
+	staging := path.Join(s.basePath, stagingDir)
+	staged := path.Join(staging, stagedMarker)
+	if _, err = os.Stat(staged); os.IsNotExist(err) {
+		err = s.stageLegacyNames(staging)
+		if err == nil {
+			err = os.WriteFile(staged, nil, 0644)
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	files, err := os.ReadDir(staging)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if file.Name() == stagedMarker {
+			continue
+		}
+		err = os.Rename(path.Join(staging, file.Name()), path.Join(s.basePath, file.Name()))
+		if err != nil {
+			return
+		}
+	}
+	err = os.WriteFile(path.Join(s.basePath, escapedMarker), nil, 0644)
+	if err == nil {
+		err = os.RemoveAll(staging)
+	}
+	if err == nil {
+		err = s.syncDir()
+	}
+	return
+}
+
+// stageLegacyNames moves the files whose names change once escaped into
+// staging, under their escaped names.
+func (s *KeyValueStore) stageLegacyNames(staging string) (err error) {
+	err = os.MkdirAll(staging, 0777)
+	if err != nil {
+		return
+	}
+	files, err := os.ReadDir(s.basePath)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		escaped := keyEscaper.Replace(file.Name())
+		if file.IsDir() || escaped == file.Name() {
+			continue
+		}
+		log.Println("Escaping file name of key", file.Name())
+		err = os.Rename(path.Join(s.basePath, file.Name()), path.Join(staging, escaped))
+		if err != nil {
+			return
+		}
+	}
+	return nil
+}
@@ -2,11 +2,13 @@ package io
 
 import (
 	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
 func TestNewKeyValueStore(t *testing.T) {
-	a := NewKeyValueStore(getBasePath() + "/data/")
+	a := NewKeyValueStore(t.TempDir())
 
 	err := a.Put("foo", "bar")
 	assert.Nil(t, err)
@@ -14,4 +16,76 @@ func TestNewKeyValueStore(t *testing.T) {
 	val, err := a.Get("foo")
 	assert.Nil(t, err)
 	assert.Equal(t, "bar", val)
+
+	assert.Nil(t, a.Del("foo"))
+	assert.Nil(t, a.Del("foo"))
+	_, err = a.Get("foo")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestKeyValueStoreRemovesPartials(t *testing.T) {
+	dir := t.TempDir()
+	a := NewKeyValueStore(dir)
+	err := a.Put("foo", "bar")
+	assert.Nil(t, err)
+
+	// Simulate a crash in the middle of overwriting foo.
+	err = os.WriteFile(filepath.Join(dir, partialDir, "foo"), []byte("tru"), 0777)
+	assert.Nil(t, err)
+	// A key may look like a partial file
+	err = a.Put("baz.partial", "qux")
+	assert.Nil(t, err)
+
+	b := NewKeyValueStore(dir)
+	keys, err := b.List()
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"foo", "baz.partial"}, keys)
+
+	val, err := b.Get("foo")
+	assert.Nil(t, err)
+	assert.Equal(t, "bar", val)
+	val, err = b.Get("baz.partial")
+	assert.Nil(t, err)
+	assert.Equal(t, "qux", val)
+
+	_, err = os.Stat(filepath.Join(dir, partialDir, "foo"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestKeyValueStoreHierarchicalKeys(t *testing.T) {
+	a := NewKeyValueStore(t.TempDir())
+	assert.Nil(t, a.Put("ns/table/key", "bar"))
+	assert.Nil(t, a.Put("100%", "baz"))
+
+	val, err := a.Get("ns/table/key")
+	assert.Nil(t, err)
+	assert.Equal(t, "bar", val)
+
+	keys, err := a.List()
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"ns/table/key", "100%"}, keys)
+}
+
+func TestKeyValueStoreEscapesLegacyNames(t *testing.T) {
+	dir := t.TempDir()
+	// Written before keys were escaped, the second name is how the first
+	// one escapes
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "a%41"), []byte("1"), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "a%2541"), []byte("2"), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "plain"), []byte("3"), 0644))
+
+	a := NewKeyValueStore(dir)
+	keys, err := a.List()
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"a%41", "a%2541", "plain"}, keys)
+	for key, want := range map[string]string{"a%41": "1", "a%2541": "2", "plain": "3"} {
+		val, err := a.Get(key)
+		assert.Nil(t, err)
+		assert.Equal(t, want, val)
+	}
+
+	// Opening it again leaves the escaped names alone
+	keys, err = NewKeyValueStore(dir).List()
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"a%41", "a%2541", "plain"}, keys)
 }
@@ -0,0 +1,140 @@
+package io
+
+import (
+	"errors"
+	"io/fs"
+	"sync"
+)
+
+// SnapshotStore lets a store be copied as of one moment while writes go on.
+// Between Freeze and Thaw the first write to a key that existed at Freeze
+// saves what it held before, and ReadFrozen returns that instead of the
+// current value. It sits right above the files, so it keeps values as stored.
+type SnapshotStore struct {
+	IKeyValueStore
+	mu sync.Mutex
+	// frozen maps the keys there were at Freeze to the value they had then,
+	// saved when a write first replaced it. Nil means none did yet.
+	frozen map[string]*string
+}
+
+func NewSnapshotStore(store IKeyValueStore) *SnapshotStore {
+	return &SnapshotStore{IKeyValueStore: store}
+}
+
+func (s *SnapshotStore) Unwrap() IKeyValueStore {
+	return s.IKeyValueStore
+}
+
+func (s *SnapshotStore) Put(key string, value string) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err = s.save(key)
+	if err != nil {
+		return
+	}
+	return s.IKeyValueStore.Put(key, value)
+}
+
+func (s *SnapshotStore) Del(key string) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err = s.save(key)
+	if err != nil {
+		return
+	}
+	return s.IKeyValueStore.Del(key)
+}
+
+// save keeps the value key had at Freeze before it is first replaced. It must
+// be called with mu held.
+func (s *SnapshotStore) save(key string) (err error) {
+	saved, ok := s.frozen[key]
+	if !ok || saved != nil {
+		return nil
+	}
+	value, err := s.IKeyValueStore.Get(key)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Gone before we got to it, nothing to keep
+		delete(s.frozen, key)
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	s.frozen[key] = &value
+	return nil
+}
+
+// Freeze records the keys the store holds now. Only the file names are read,
+// so it is quick. A store can be frozen once at a time.
+func (s *SnapshotStore) Freeze() (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.frozen != nil {
+		return errors.New("store is frozen already")
+	}
+	keys, err := s.IKeyValueStore.List()
+	if err != nil {
+		return
+	}
+	s.frozen = make(map[string]*string, len(keys))
+	for _, key := range keys {
+		s.frozen[key] = nil
+	}
+	return nil
+}
+
+// ReadFrozen returns the keys and values the store held at Freeze.
+func (s *SnapshotStore) ReadFrozen() (values map[string]string, err error) {
+	s.mu.Lock()
+	keys := make([]string, 0, len(s.frozen))
+	for key := range s.frozen {
+		keys = append(keys, key)
+	}
+	s.mu.Unlock()
+
+	values = make(map[string]string, len(keys))
+	for _, key := range keys {
+		err = s.readFrozen(key, values)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+func (s *SnapshotStore) readFrozen(key string, values map[string]string) (err error) {
+	// Holding mu keeps a write from replacing the value while it is read
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	saved, ok := s.frozen[key]
+	if !ok {
+		return nil
+	}
+	if saved != nil {
+		values[key] = *saved
+		return nil
+	}
+	value, err := s.IKeyValueStore.Get(key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	values[key] = value
+	return nil
+}
+
+// Thaw drops what Freeze kept.
+func (s *SnapshotStore) Thaw() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.frozen = nil
+}
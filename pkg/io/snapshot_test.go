@@ -0,0 +1,34 @@
+package io
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSnapshotStoreReadsAsOfFreeze(t *testing.T) {
+	store := NewSnapshotStore(NewKeyValueStore(t.TempDir()))
+	assert.Nil(t, store.Put("kept", "a"))
+	assert.Nil(t, store.Put("changed", "b"))
+	assert.Nil(t, store.Put("deleted", "c"))
+
+	assert.Nil(t, store.Freeze())
+	assert.NotNil(t, store.Freeze())
+	assert.Nil(t, store.Put("changed", "b2"))
+	assert.Nil(t, store.Put("changed", "b3"))
+	assert.Nil(t, store.Del("deleted"))
+	assert.Nil(t, store.Put("added", "d"))
+
+	values, err := store.ReadFrozen()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"kept": "a", "changed": "b", "deleted": "c"}, values)
+
+	current, err := store.Get("changed")
+	assert.Nil(t, err)
+	assert.Equal(t, "b3", current)
+
+	store.Thaw()
+	assert.Nil(t, store.Freeze())
+	values, err = store.ReadFrozen()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"kept": "a", "changed": "b3", "added": "d"}, values)
+}
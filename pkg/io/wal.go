@@ -2,17 +2,43 @@ package io
 
 import (
 	"encoding/csv"
+	"errors"
+	"fmt"
+	goio "io"
 	"log"
 	"os"
 	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 	"twopc/pkg/common"
 )
 
+// maxWriteFailures is how many writes in a row may fail before the logger
+// gives up on the disk and rejects further writes. After
+// degradedRetryInterval the next write is tried again, and if it goes
+// through the logger is back in service.
+const (
+	maxWriteFailures      = 3
+	degradedRetryInterval = 10 * time.Second
+)
+
+var (
+	LoggerDegradedError = errors.New("logger degraded after repeated write failures")
+)
+
 type ILogger interface {
-	WriteSpecial(directive string)
-	WriteState(txId string, state common.TxState)
-	WriteOp(txId string, state common.TxState, op common.Operation, key string)
+	WriteSpecial(directive string) (err error)
+	WriteState(txId string, state common.TxState) (err error)
+	WriteStart(txId string, participants []int) (err error)
+	WriteOp(txId string, state common.TxState, op common.Operation, key string) (err error)
 	Read() (entries []logEntry, err error)
+	Position() int64
+	ReadPrefix(position int64) (data []byte, err error)
+	WriteRaw(data []byte) (err error)
+	Reset() (err error)
+	Degraded() bool
 }
 
 type Logger struct {
@@ -20,21 +46,35 @@ type Logger struct {
 	file      *os.File
 	csvWriter *csv.Writer
 	requests  chan *logRequest
+
+	// offset is the size of the log once every acknowledged write is flushed.
+	// failures counts the writes that failed in a row, the last at failedAt.
+	mu       sync.Mutex
+	offset   int64
+	failures int
+	failedAt time.Time
 }
 
 func NewLogger(logFilePath string) *Logger {
-	err := os.MkdirAll(path.Dir(logFilePath), 0)
-	//file, err := os.OpenFile(logFilePath, os.O_APPEND|os.O_CREATE, 0)
+	err := os.MkdirAll(path.Dir(logFilePath), 0777)
+	if err != nil {
+		log.Fatalln("newLogger:", err)
+	}
 	file, err := os.OpenFile(logFilePath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
 		log.Fatalln("newLogger:", err)
 	}
+	info, err := file.Stat()
+	if err != nil {
+		log.Fatalln("newLogger:", err)
+	}
 
 	l := &Logger{
 		path:      logFilePath,
 		file:      file,
 		csvWriter: csv.NewWriter(file),
 		requests:  make(chan *logRequest),
+		offset:    info.Size(),
 	}
 
 	go l.loggingLoop()
@@ -45,18 +85,111 @@ func NewLogger(logFilePath string) *Logger {
 func (l *Logger) loggingLoop() {
 	for {
 		req := <-l.requests
-		err := l.csvWriter.Write(req.record)
+		if l.Degraded() {
+			req.done <- LoggerDegradedError
+			continue
+		}
+
+		var err error
+		switch {
+		case req.reset:
+			err = l.reset()
+		case req.raw != nil:
+			err = l.writeRaw(req.raw)
+		default:
+			err = l.write(req.record)
+		}
+		l.mu.Lock()
 		if err != nil {
-			log.Fatalln("logger.write fatal:", err)
+			l.failures++
+			l.failedAt = time.Now()
+			log.Println("logger.write failed:", err, "failures:", l.failures)
+			if l.failures >= maxWriteFailures {
+				log.Println("logger.write: too many failures, entering degraded mode")
+			}
+		} else {
+			if l.failures >= maxWriteFailures {
+				log.Println("logger.write succeeded again, leaving degraded mode")
+			}
+			l.failures = 0
 		}
+		l.mu.Unlock()
+		req.done <- err
+	}
+}
 
+// write appends and syncs a single record. On failure the log is cut back to
+// the last acknowledged offset so a torn record never reaches Read.
+func (l *Logger) write(record []string) (err error) {
+	err = l.csvWriter.Write(record)
+	if err == nil {
 		l.csvWriter.Flush()
+		err = l.csvWriter.Error()
+	}
+	if err == nil {
 		err = l.file.Sync()
-		if err != nil {
-			log.Fatalln("logger.write fatal:", err)
-		}
-		req.done <- 1
 	}
+	var info os.FileInfo
+	if err == nil {
+		info, err = l.file.Stat()
+	}
+	if err != nil {
+		l.csvWriter = csv.NewWriter(l.file)
+		_ = l.file.Truncate(l.Position())
+		return
+	}
+
+	l.mu.Lock()
+	l.offset = info.Size()
+	l.mu.Unlock()
+	return nil
+}
+
+// writeRaw appends and syncs data as is, cutting the log back on failure
+// like write.
+func (l *Logger) writeRaw(data []byte) (err error) {
+	_, err = l.file.Write(data)
+	if err == nil {
+		err = l.file.Sync()
+	}
+	var info os.FileInfo
+	if err == nil {
+		info, err = l.file.Stat()
+	}
+	if err != nil {
+		_ = l.file.Truncate(l.Position())
+		return
+	}
+
+	l.mu.Lock()
+	l.offset = info.Size()
+	l.mu.Unlock()
+	return nil
+}
+
+func (l *Logger) reset() (err error) {
+	err = l.file.Truncate(0)
+	if err == nil {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		return
+	}
+	l.csvWriter = csv.NewWriter(l.file)
+
+	l.mu.Lock()
+	l.offset = 0
+	l.mu.Unlock()
+	return nil
+}
+
+// Degraded reports whether the logger stopped accepting writes. Callers should
+// switch to read-only operation since nothing they do can be made durable,
+// until degradedRetryInterval after the last failure.
+func (l *Logger) Degraded() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.failures >= maxWriteFailures && time.Since(l.failedAt) < degradedRetryInterval
 }
 
 func (l *Logger) Read() (entries []logEntry, err error) {
@@ -85,30 +218,102 @@ func (l *Logger) Read() (entries []logEntry, err error) {
 	return
 }
 
-func (l *Logger) WriteSpecial(directive string) {
-	l.WriteOp(directive, common.NoState, common.NoOp, "")
+// Position returns the log offset covering every write acknowledged so far.
+func (l *Logger) Position() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.offset
+}
+
+// ReadPrefix returns the raw log contents up to position.
+func (l *Logger) ReadPrefix(position int64) (data []byte, err error) {
+	file, err := os.Open(l.path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	data = make([]byte, position)
+	_, err = goio.ReadFull(file, data)
+	return
+}
+
+func (l *Logger) WriteSpecial(directive string) (err error) {
+	return l.WriteOp(directive, common.NoState, common.NoOp, "")
+}
+
+func (l *Logger) WriteState(txId string, state common.TxState) (err error) {
+	return l.WriteOp(txId, state, common.NoOp, "")
 }
 
-func (l *Logger) WriteState(txId string, state common.TxState) {
-	l.WriteOp(txId, state, common.NoOp, "")
+// WriteStart records the start of txId along with the replicas it runs on,
+// which go in the key column. A tx that reaches more replicas later logs its
+// start again with all of them.
+func (l *Logger) WriteStart(txId string, participants []int) (err error) {
+	return l.WriteOp(txId, common.Started, common.NoOp, FormatParticipants(participants))
 }
 
-func (l *Logger) WriteOp(txId string, state common.TxState, op common.Operation, key string) {
-	record := []string{txId, state.String(), op.String(), key}
-	done := make(chan int)
-	l.requests <- &logRequest{record, done}
-	<-done
+// WriteCommit records the decision to commit txId along with the timestamp it
+// commits at, which goes in the key column.
+func (l *Logger) WriteCommit(txId string, commitTs string) (err error) {
+	return l.WriteOp(txId, common.Committed, common.NoOp, commitTs)
+}
+
+func (l *Logger) WriteOp(txId string, state common.TxState, op common.Operation, key string) (err error) {
+	return l.do(&logRequest{record: []string{txId, state.String(), op.String(), key}})
+}
+
+// WriteRaw appends data, such as the log of another replica, as is.
+func (l *Logger) WriteRaw(data []byte) (err error) {
+	return l.do(&logRequest{raw: data})
+}
+
+// Reset empties the log.
+func (l *Logger) Reset() (err error) {
+	return l.do(&logRequest{reset: true})
+}
+
+func (l *Logger) do(req *logRequest) (err error) {
+	req.done = make(chan error)
+	l.requests <- req
+	return <-req.done
 }
 
 // -------------------------------------------------------------------------
 type logRequest struct {
 	record []string
-	done   chan int
+	// raw is written instead of record if set, reset empties the log.
+	raw   []byte
+	reset bool
+	done  chan error
 }
 
 type logEntry struct {
 	TxId  string
 	State common.TxState
 	Op    common.Operation
-	Key   string
+	// Key is the key of a replica op, the participants of a master start
+	// record, or the commit timestamp of a master commit record.
+	Key string
+}
+
+// FormatParticipants lists replica ids separated by spaces.
+func FormatParticipants(participants []int) string {
+	fields := make([]string, len(participants))
+	for i, p := range participants {
+		fields[i] = strconv.Itoa(p)
+	}
+	return strings.Join(fields, " ")
+}
+
+// ParseParticipants reads the participants of a start record.
+func ParseParticipants(s string) (participants []int, err error) {
+	for _, field := range strings.Fields(s) {
+		p, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, errors.New(fmt.Sprint("Malformed participants ", s, ": ", err))
+		}
+		participants = append(participants, p)
+	}
+	return
 }
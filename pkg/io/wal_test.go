@@ -0,0 +1,114 @@
+package io
+
+import (
+	"encoding/csv"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"twopc/pkg/common"
+)
+
+func TestLoggerReadsBackWrites(t *testing.T) {
+	l := NewLogger(filepath.Join(t.TempDir(), "log.txt"))
+
+	assert.Nil(t, l.WriteOp("1", common.Prepared, common.PutOp, "foo"))
+	assert.Nil(t, l.WriteState("1", common.Committed))
+
+	entries, err := l.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, []logEntry{
+		{TxId: "1", State: common.Prepared, Op: common.PutOp, Key: "foo"},
+		{TxId: "1", State: common.Committed, Op: common.NoOp, Key: ""},
+	}, entries)
+
+	data, err := l.ReadPrefix(l.Position())
+	assert.Nil(t, err)
+	assert.Equal(t, "1,PREPARED,PUT,foo\n1,COMMITTED,NOOP,\n", string(data))
+}
+
+func TestLoggerRecordsParticipants(t *testing.T) {
+	l := NewLogger(filepath.Join(t.TempDir(), "log.txt"))
+
+	assert.Nil(t, l.WriteStart("1", []int{0, 2}))
+	assert.Nil(t, l.WriteStart("2", nil))
+
+	entries, err := l.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, common.Started, entries[0].State)
+	participants, err := ParseParticipants(entries[0].Key)
+	assert.Nil(t, err)
+	assert.Equal(t, []int{0, 2}, participants)
+	participants, err = ParseParticipants(entries[1].Key)
+	assert.Nil(t, err)
+	assert.Empty(t, participants)
+
+	_, err = ParseParticipants("0 x")
+	assert.NotNil(t, err)
+}
+
+func TestLoggerCopiesAnotherLog(t *testing.T) {
+	source := NewLogger(filepath.Join(t.TempDir(), "log.txt"))
+	assert.Nil(t, source.WriteOp("1", common.Prepared, common.PutOp, "foo"))
+	data, err := source.ReadPrefix(source.Position())
+	assert.Nil(t, err)
+
+	l := NewLogger(filepath.Join(t.TempDir(), "log.txt"))
+	assert.Nil(t, l.WriteRaw(data))
+	assert.Nil(t, l.WriteState("1", common.Committed))
+	entries, err := l.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, []logEntry{
+		{TxId: "1", State: common.Prepared, Op: common.PutOp, Key: "foo"},
+		{TxId: "1", State: common.Committed, Op: common.NoOp, Key: ""},
+	}, entries)
+
+	assert.Nil(t, l.Reset())
+	assert.Equal(t, int64(0), l.Position())
+	entries, err = l.Read()
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestLoggerDegradesAfterRepeatedFailures(t *testing.T) {
+	l := NewLogger(filepath.Join(t.TempDir(), "log.txt"))
+	assert.Nil(t, l.WriteState("1", common.Started))
+
+	// Pull the file out from under the logger so every write fails.
+	_ = l.file.Close()
+
+	for i := 0; i < maxWriteFailures; i++ {
+		assert.False(t, l.Degraded())
+		assert.NotNil(t, l.WriteState("2", common.Started))
+	}
+	assert.True(t, l.Degraded())
+	assert.Equal(t, LoggerDegradedError, l.WriteState("3", common.Started))
+
+	entries, err := l.Read()
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+
+	// Once the retry interval is up the next write is tried, and fails again
+	l.mu.Lock()
+	l.failedAt = time.Now().Add(-degradedRetryInterval)
+	l.mu.Unlock()
+	assert.False(t, l.Degraded())
+	assert.NotNil(t, l.WriteState("4", common.Started))
+	assert.True(t, l.Degraded())
+
+	// The disk is back: a write goes through and the logger recovers
+	l.file, err = os.OpenFile(l.path, os.O_APPEND|os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	l.csvWriter = csv.NewWriter(l.file)
+	l.mu.Lock()
+	l.failedAt = time.Now().Add(-degradedRetryInterval)
+	l.mu.Unlock()
+	assert.Nil(t, l.WriteState("5", common.Started))
+	assert.False(t, l.Degraded())
+	assert.Nil(t, l.WriteState("6", common.Started))
+
+	entries, err = l.Read()
+	assert.Nil(t, err)
+	assert.Len(t, entries, 3)
+}
@@ -0,0 +1,487 @@
+package lock
+
+import (
+	"errors"
+	"sync"
+	"time"
+	"twopc/pkg/common"
+)
+
+var (
+	TimeoutError   = errors.New("timed out waiting for lock")
+	CancelledError = errors.New("lock request cancelled")
+	DiedError      = errors.New("lock held by an older transaction, dying")
+)
+
+// Policy decides what a tx does when a key it wants is taken. Both wait-die
+// and wound-wait only ever let an older tx wait for a younger one or the
+// other way round, never both, so no deadlock can form.
+type Policy int
+
+const (
+	// WaitForLock queues behind the holders and relies on timeouts and the
+	// master's deadlock detector.
+	WaitForLock Policy = iota
+	// WaitDie lets an older tx wait, a younger one aborts right away.
+	WaitDie
+	// WoundWait has an older tx abort the younger ones in its way, while a
+	// younger tx waits.
+	WoundWait
+)
+
+func (p Policy) String() string {
+	switch p {
+	case WaitForLock:
+		return "wait"
+	case WaitDie:
+		return "wait-die"
+	case WoundWait:
+		return "wound-wait"
+	default:
+		panic("unhandled default case")
+	}
+}
+
+func ParsePolicy(s string) (Policy, error) {
+	switch s {
+	case "wait":
+		return WaitForLock, nil
+	case "wait-die":
+		return WaitDie, nil
+	case "wound-wait":
+		return WoundWait, nil
+	}
+	return WaitForLock, errors.New("unknown deadlock policy: " + s)
+}
+
+// Mode is how a tx holds a lock. The intention modes go on the parents of a
+// hierarchical key, saying the tx holds, or will hold, the matching lock on
+// something below.
+type Mode int
+
+const (
+	Shared Mode = iota
+	Exclusive
+	IntentionShared
+	IntentionExclusive
+	// SharedIntentionExclusive is Shared on the node plus IntentionExclusive
+	// for writing some of what's below.
+	SharedIntentionExclusive
+)
+
+func (m Mode) String() string {
+	switch m {
+	case Shared:
+		return "S"
+	case Exclusive:
+		return "X"
+	case IntentionShared:
+		return "IS"
+	case IntentionExclusive:
+		return "IX"
+	case SharedIntentionExclusive:
+		return "SIX"
+	default:
+		panic("unhandled default case")
+	}
+}
+
+// compatibility[a] lists the modes other txs may hold alongside a.
+var compatibility = map[Mode][]Mode{
+	IntentionShared:          {IntentionShared, IntentionExclusive, Shared, SharedIntentionExclusive},
+	IntentionExclusive:       {IntentionShared, IntentionExclusive},
+	Shared:                   {IntentionShared, Shared},
+	SharedIntentionExclusive: {IntentionShared},
+	Exclusive:                {},
+}
+
+func (m Mode) compatible(other Mode) bool {
+	for _, c := range compatibility[m] {
+		if c == other {
+			return true
+		}
+	}
+	return false
+}
+
+// covers reports whether holding m gives everything other would.
+func (m Mode) covers(other Mode) bool {
+	return m == other || m.join(other) == m
+}
+
+// join returns the weakest mode covering both m and other.
+func (m Mode) join(other Mode) Mode {
+	switch {
+	case m == other:
+		return m
+	case m == Exclusive || other == Exclusive:
+		return Exclusive
+	case m == IntentionShared:
+		return other
+	case other == IntentionShared:
+		return m
+	default:
+		// Any two of S, IX and SIX
+		return SharedIntentionExclusive
+	}
+}
+
+type ILockManager interface {
+	Lock(txId string, key string, mode Mode, timeout time.Duration) (err error)
+	Unlock(txId string, key string)
+	UnlockAll(txId string)
+	Cancel(txId string)
+	Holds(txId string, key string) bool
+	WaitForEdges() (edges []Edge)
+	Renew(txIds []string)
+	ExpiredLeases() (txIds []string)
+	Locks() (locks []LockInfo)
+}
+
+// LockInfo is a lock held or waited for. Since is when it was granted, or
+// when the wait began.
+type LockInfo struct {
+	TxId    string
+	Key     string
+	Mode    Mode
+	Waiting bool
+	Since   time.Time
+}
+
+// Edge says Waiter can't get Key until Holder lets go of it.
+type Edge struct {
+	Waiter string
+	Holder string
+	Key    string
+}
+
+// Manager hands out locks on keys in the modes above. A tx that finds a key
+// locked in a conflicting mode waits in a FIFO queue until the lock is passed
+// on to it or its wait time runs out. A tx upgrading a lock it holds goes to
+// the head of the queue, since nobody behind it can get in anyway.
+type Manager struct {
+	mu    sync.Mutex
+	locks map[string]*lockState
+	// held maps a tx to the keys it holds, for UnlockAll.
+	held map[string]map[string]bool
+
+	opts Options
+	// leases maps a tx holding locks to when its lease runs out.
+	leases map[string]time.Time
+}
+
+type Options struct {
+	Policy Policy
+	// Wound asks for txId to be aborted. It is only used by WoundWait and is
+	// called without holding any lock.
+	Wound func(txId string)
+	// Lease is how long a tx keeps its locks without being renewed. Zero
+	// means forever. An expired lease releases nothing by itself, it only
+	// shows up in ExpiredLeases for the owner to look into.
+	Lease time.Duration
+}
+
+type lockState struct {
+	holders map[string]Mode
+	// since is when each holder first got the lock.
+	since   map[string]time.Time
+	waiters []*waiter
+}
+
+type waiter struct {
+	txId  string
+	mode  Mode
+	since time.Time
+	// result receives nil once the lock is granted, or why it never will be.
+	result chan error
+}
+
+func NewManager() *Manager {
+	return NewManagerWithOptions(Options{})
+}
+
+// NewManagerWithOptions returns a manager resolving conflicts by opts.Policy.
+// Unless it is WaitForLock, tx ids must be start timestamps as handed out by
+// the master.
+func NewManagerWithOptions(opts Options) *Manager {
+	return &Manager{
+		locks:  make(map[string]*lockState),
+		held:   make(map[string]map[string]bool),
+		opts:   opts,
+		leases: make(map[string]time.Time),
+	}
+}
+
+// Lock blocks until txId holds key in mode or timeout passes. A zero timeout
+// fails straight away if the key is locked in a conflicting mode.
+func (m *Manager) Lock(txId string, key string, mode Mode, timeout time.Duration) (err error) {
+	m.mu.Lock()
+	l, ok := m.locks[key]
+	if !ok {
+		l = &lockState{holders: make(map[string]Mode), since: make(map[string]time.Time)}
+		m.locks[key] = l
+	}
+	current, holds := l.holders[txId]
+	if holds {
+		if current.covers(mode) {
+			m.mu.Unlock()
+			return nil
+		}
+		mode = current.join(mode)
+	}
+	upgrade := holds
+	if (upgrade || len(l.waiters) == 0) && l.grantable(txId, mode) {
+		m.grant(l, txId, key, mode)
+		m.mu.Unlock()
+		return nil
+	}
+	if timeout <= 0 {
+		m.mu.Unlock()
+		return TimeoutError
+	}
+
+	var wounded []string
+	switch m.opts.Policy {
+	case WaitDie:
+		for _, b := range l.blockers(txId, mode, upgrade) {
+			if common.TxOlder(b, txId) {
+				m.mu.Unlock()
+				return DiedError
+			}
+		}
+	case WoundWait:
+		for _, b := range l.blockers(txId, mode, upgrade) {
+			if common.TxOlder(txId, b) {
+				wounded = append(wounded, b)
+			}
+		}
+	}
+
+	w := &waiter{txId: txId, mode: mode, since: time.Now(), result: make(chan error, 1)}
+	if upgrade {
+		l.waiters = append([]*waiter{w}, l.waiters...)
+	} else {
+		l.waiters = append(l.waiters, w)
+	}
+	m.mu.Unlock()
+
+	for _, b := range wounded {
+		if m.opts.Wound != nil {
+			m.opts.Wound(b)
+		}
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err = <-w.result:
+		return
+	case <-timer.C:
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !l.remove(w) {
+		// Granted or cancelled while the timer fired
+		return <-w.result
+	}
+	// Leaving may let the waiters behind us in
+	m.grantWaiters(l, key)
+	return TimeoutError
+}
+
+// Unlock releases key if txId holds it and hands it to the waiters at the
+// head of the queue.
+func (m *Manager) Unlock(txId string, key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.unlock(txId, key)
+}
+
+// UnlockAll releases every key txId holds.
+func (m *Manager) UnlockAll(txId string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key := range m.held[txId] {
+		m.unlock(txId, key)
+	}
+}
+
+func (m *Manager) unlock(txId string, key string) {
+	l, ok := m.locks[key]
+	if !ok {
+		return
+	}
+	if _, holds := l.holders[txId]; !holds {
+		return
+	}
+	delete(l.holders, txId)
+	delete(l.since, txId)
+	delete(m.held[txId], key)
+	if len(m.held[txId]) == 0 {
+		delete(m.held, txId)
+		delete(m.leases, txId)
+	}
+	m.grantWaiters(l, key)
+}
+
+// grantWaiters grants the lock to waiters from the head of the queue for as
+// long as they fit with the current holders.
+func (m *Manager) grantWaiters(l *lockState, key string) {
+	for len(l.waiters) > 0 && l.grantable(l.waiters[0].txId, l.waiters[0].mode) {
+		w := l.waiters[0]
+		l.waiters = l.waiters[1:]
+		m.grant(l, w.txId, key, w.mode)
+		w.result <- nil
+	}
+	if len(l.holders) == 0 && len(l.waiters) == 0 {
+		delete(m.locks, key)
+	}
+}
+
+func (m *Manager) grant(l *lockState, txId string, key string, mode Mode) {
+	l.holders[txId] = mode
+	if _, ok := l.since[txId]; !ok {
+		l.since[txId] = time.Now()
+	}
+	if m.held[txId] == nil {
+		m.held[txId] = make(map[string]bool)
+	}
+	m.held[txId][key] = true
+	if _, ok := m.leases[txId]; !ok && m.opts.Lease > 0 {
+		m.leases[txId] = time.Now().Add(m.opts.Lease)
+	}
+}
+
+// Renew extends the leases of txIds that hold locks.
+func (m *Manager) Renew(txIds []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.opts.Lease <= 0 {
+		return
+	}
+	for _, txId := range txIds {
+		if _, ok := m.leases[txId]; ok {
+			m.leases[txId] = time.Now().Add(m.opts.Lease)
+		}
+	}
+}
+
+// ExpiredLeases returns the txs holding locks whose lease ran out.
+func (m *Manager) ExpiredLeases() (txIds []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for txId, expiry := range m.leases {
+		if now.After(expiry) {
+			txIds = append(txIds, txId)
+		}
+	}
+	return
+}
+
+// Cancel fails every pending Lock call of txId with CancelledError.
+func (m *Manager) Cancel(txId string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, l := range m.locks {
+		cancelled := false
+		for _, w := range append([]*waiter(nil), l.waiters...) {
+			if w.txId == txId {
+				l.remove(w)
+				w.result <- CancelledError
+				cancelled = true
+			}
+		}
+		if cancelled {
+			m.grantWaiters(l, key)
+		}
+	}
+}
+
+// Holds reports whether txId holds key in any mode.
+func (m *Manager) Holds(txId string, key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.held[txId][key]
+}
+
+// WaitForEdges returns the local wait-for graph. Since locks are granted in
+// order, a waiter also waits for everyone queued ahead of it.
+func (m *Manager) WaitForEdges() (edges []Edge) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, l := range m.locks {
+		for i, w := range l.waiters {
+			for holder := range l.holders {
+				if holder != w.txId {
+					edges = append(edges, Edge{Waiter: w.txId, Holder: holder, Key: key})
+				}
+			}
+			for _, ahead := range l.waiters[:i] {
+				edges = append(edges, Edge{Waiter: w.txId, Holder: ahead.txId, Key: key})
+			}
+		}
+	}
+	return
+}
+
+// Locks returns every lock held or waited for.
+func (m *Manager) Locks() (locks []LockInfo) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, l := range m.locks {
+		for txId, mode := range l.holders {
+			locks = append(locks, LockInfo{TxId: txId, Key: key, Mode: mode, Since: l.since[txId]})
+		}
+		for _, w := range l.waiters {
+			locks = append(locks, LockInfo{TxId: w.txId, Key: key, Mode: w.mode, Waiting: true, Since: w.since})
+		}
+	}
+	return
+}
+
+// grantable reports whether txId could hold the lock in mode alongside the
+// current holders.
+func (l *lockState) grantable(txId string, mode Mode) bool {
+	for holder, held := range l.holders {
+		if holder != txId && !mode.compatible(held) {
+			return false
+		}
+	}
+	return true
+}
+
+// blockers returns the txs txId would have to wait for: the holders it
+// conflicts with and, unless it jumps the queue to upgrade, every waiter.
+func (l *lockState) blockers(txId string, mode Mode, upgrade bool) (txIds []string) {
+	for holder, held := range l.holders {
+		if holder != txId && !mode.compatible(held) {
+			txIds = append(txIds, holder)
+		}
+	}
+	if !upgrade {
+		for _, w := range l.waiters {
+			txIds = append(txIds, w.txId)
+		}
+	}
+	return
+}
+
+func (l *lockState) remove(w *waiter) bool {
+	for i, other := range l.waiters {
+		if other == w {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
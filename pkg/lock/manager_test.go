@@ -0,0 +1,160 @@
+package lock
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestManagerGrantsInFifoOrder(t *testing.T) {
+	m := NewManager()
+	assert.Nil(t, m.Lock("1", "foo", Exclusive, 0))
+
+	order := make(chan string, 2)
+	for _, txId := range []string{"2", "3"} {
+		go func(txId string) {
+			assert.Nil(t, m.Lock(txId, "foo", Exclusive, time.Second))
+			order <- txId
+			m.Unlock(txId, "foo")
+		}(txId)
+		// Make sure 2 queues up before 3.
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	m.Unlock("1", "foo")
+	assert.Equal(t, "2", <-order)
+	assert.Equal(t, "3", <-order)
+	assert.False(t, m.Holds("3", "foo"))
+}
+
+func TestManagerTimesOutAndCancels(t *testing.T) {
+	m := NewManager()
+	assert.Nil(t, m.Lock("1", "foo", Exclusive, 0))
+	assert.Equal(t, TimeoutError, m.Lock("2", "foo", Exclusive, 0))
+	assert.Equal(t, TimeoutError, m.Lock("2", "foo", Exclusive, 20*time.Millisecond))
+
+	done := make(chan error)
+	go func() { done <- m.Lock("3", "foo", Exclusive, time.Second) }()
+	time.Sleep(20 * time.Millisecond)
+	m.Cancel("3")
+	assert.Equal(t, CancelledError, <-done)
+
+	// Nobody is left waiting, so the key is free again.
+	m.Unlock("1", "foo")
+	assert.Nil(t, m.Lock("4", "foo", Exclusive, 0))
+}
+
+func TestManagerSharedAndExclusive(t *testing.T) {
+	m := NewManager()
+	assert.Nil(t, m.Lock("1", "foo", Shared, 0))
+	assert.Nil(t, m.Lock("2", "foo", Shared, 0))
+	assert.Equal(t, TimeoutError, m.Lock("3", "foo", Exclusive, 0))
+
+	// 1 can only upgrade once 2 lets go.
+	upgraded := make(chan error)
+	go func() { upgraded <- m.Lock("1", "foo", Exclusive, time.Second) }()
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, []Edge{{Waiter: "1", Holder: "2", Key: "foo"}}, m.WaitForEdges())
+
+	m.UnlockAll("2")
+	assert.Nil(t, <-upgraded)
+	assert.Equal(t, TimeoutError, m.Lock("2", "foo", Shared, 0))
+
+	m.UnlockAll("1")
+	assert.Nil(t, m.Lock("2", "foo", Shared, 0))
+}
+
+func TestManagerWaitDie(t *testing.T) {
+	m := NewManagerWithOptions(Options{Policy: WaitDie})
+	assert.Nil(t, m.Lock("200", "foo", Exclusive, 0))
+
+	// Younger than the holder, so it dies instead of waiting.
+	assert.Equal(t, DiedError, m.Lock("300", "foo", Exclusive, time.Second))
+
+	// Older than the holder, so it waits its turn.
+	done := make(chan error)
+	go func() { done <- m.Lock("100", "foo", Exclusive, time.Second) }()
+	time.Sleep(20 * time.Millisecond)
+	m.Unlock("200", "foo")
+	assert.Nil(t, <-done)
+}
+
+func TestManagerWoundWait(t *testing.T) {
+	wounded := make(chan string, 1)
+	m := NewManagerWithOptions(Options{Policy: WoundWait, Wound: func(txId string) { wounded <- txId }})
+	assert.Nil(t, m.Lock("200", "foo", Exclusive, 0))
+
+	// Younger than the holder, so it just waits.
+	assert.Equal(t, TimeoutError, m.Lock("300", "foo", Exclusive, 20*time.Millisecond))
+	assert.Len(t, wounded, 0)
+
+	// Older than the holder, so the holder gets wounded.
+	done := make(chan error)
+	go func() { done <- m.Lock("100", "foo", Exclusive, time.Second) }()
+	assert.Equal(t, "200", <-wounded)
+	m.UnlockAll("200")
+	assert.Nil(t, <-done)
+}
+
+func TestManagerLeases(t *testing.T) {
+	m := NewManagerWithOptions(Options{Lease: 30 * time.Millisecond})
+	assert.Nil(t, m.Lock("1", "foo", Exclusive, 0))
+	assert.Nil(t, m.Lock("2", "bar", Exclusive, 0))
+
+	time.Sleep(20 * time.Millisecond)
+	m.Renew([]string{"2"})
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, []string{"1"}, m.ExpiredLeases())
+
+	// An expired lease keeps the lock until its owner decides otherwise.
+	assert.True(t, m.Holds("1", "foo"))
+	m.UnlockAll("1")
+	assert.Empty(t, m.ExpiredLeases())
+}
+
+func TestManagerIntentionLocks(t *testing.T) {
+	m := NewManager()
+
+	// Writers below a namespace get along, a reader of all of it doesn't
+	assert.Nil(t, m.Lock("1", "ns", IntentionExclusive, 0))
+	assert.Nil(t, m.Lock("2", "ns", IntentionExclusive, 0))
+	assert.Equal(t, TimeoutError, m.Lock("3", "ns", Shared, 0))
+	assert.Nil(t, m.Lock("3", "other", Exclusive, 0))
+
+	m.UnlockAll("1")
+	m.UnlockAll("2")
+	assert.Nil(t, m.Lock("3", "ns", Shared, 0))
+	assert.Nil(t, m.Lock("4", "ns", IntentionShared, 0))
+	assert.Equal(t, TimeoutError, m.Lock("5", "ns", IntentionExclusive, 0))
+
+	// Shared plus intent to write below is SIX, which still admits readers
+	// of single keys
+	assert.Nil(t, m.Lock("3", "ns", IntentionExclusive, 0))
+	assert.Nil(t, m.Lock("4", "ns", IntentionShared, 0))
+	assert.Equal(t, TimeoutError, m.Lock("5", "ns", Shared, 0))
+}
+
+func TestModeJoin(t *testing.T) {
+	assert.Equal(t, IntentionExclusive, IntentionShared.join(IntentionExclusive))
+	assert.Equal(t, SharedIntentionExclusive, Shared.join(IntentionExclusive))
+	assert.Equal(t, Exclusive, SharedIntentionExclusive.join(Exclusive))
+	assert.True(t, Exclusive.covers(Shared))
+	assert.True(t, SharedIntentionExclusive.covers(IntentionShared))
+	assert.False(t, Shared.covers(IntentionExclusive))
+}
+
+func TestManagerLocks(t *testing.T) {
+	m := NewManager()
+	assert.Nil(t, m.Lock("1", "foo", Exclusive, 0))
+	go func() { _ = m.Lock("2", "foo", Shared, time.Second) }()
+	time.Sleep(20 * time.Millisecond)
+
+	locks := m.Locks()
+	assert.Len(t, locks, 2)
+	for _, l := range locks {
+		assert.Equal(t, "foo", l.Key)
+		assert.Equal(t, l.TxId == "2", l.Waiting)
+		assert.False(t, l.Since.IsZero())
+	}
+	m.UnlockAll("1")
+}
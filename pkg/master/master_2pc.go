@@ -7,70 +7,241 @@ import (
 	"net/http"
 	"net/rpc"
 	"os"
+	"slices"
+	"strconv"
 	"sync"
 	"time"
 	"twopc/pkg/client"
 	"twopc/pkg/common"
+	"twopc/pkg/io"
+	"twopc/pkg/lock"
 )
 
 var (
-	TxAbortedError = errors.New("transaction aborted")
+	TxAbortedError   = errors.New("transaction aborted")
+	ReadOnlyError    = errors.New("master is in read-only mode")
+	ReplicaDownError = errors.New("replica is down")
 )
 
 type IMasterTwoPC interface {
-	Mutate(operation common.Operation, key string, masterDeath common.MasterDeath, replicaDeaths []common.ReplicaDeath, f func(r *client.ReplicaClient, txId string, i int, rd common.ReplicaDeath) (*bool, error)) (err error)
+	Mutate(operation common.Operation, key string, value string, masterDeath common.MasterDeath, replicaDeaths []common.ReplicaDeath, f func(r *client.ReplicaClient, txId string, i int, rd common.ReplicaDeath) (*bool, error)) (err error)
 	SendAbort(action string, txId string)
 	SendAndWaitForCommit(action string, txId string, replicaDeaths []common.ReplicaDeath)
 	Recover() (err error)
 }
 
-func (m *Master) Mutate(operation common.Operation, key string, masterDeath common.MasterDeath, replicaDeaths []common.ReplicaDeath, f func(r *client.ReplicaClient, txId string, i int, rd common.ReplicaDeath) (*bool, error)) (err error) {
-	action := operation.String()
-	txId := fmt.Sprintf("%d", time.Now().UnixNano())
-	m.log.WriteState(txId, common.Started)
-	m.txs[txId] = common.Started
+// Mutate writes key, or deletes it, in a tx of its own. It commits once the
+// write quorum of each group the key is written to voted yes; replicas that
+// missed the write get it as a hint later.
+func (m *Master) Mutate(operation common.Operation, key string, value string, masterDeath common.MasterDeath, replicaDeaths []common.ReplicaDeath, f func(r *client.ReplicaClient, txId string, i int, rd common.ReplicaDeath) (*bool, error)) (err error) {
+	for {
+		err = m.mutate(operation, key, value, masterDeath, replicaDeaths, f)
+		if err != movedError {
+			return
+		}
+		log.Println("Master."+operation.String()+" key:", key, "moved to another group, starting over")
+	}
+}
 
-	// Send out all Mutate requests in parallel. If any abort, send on the channel.
-	// Channel must be buffered to allow the non-blocking read in the switch.
-	shouldAbort := make(chan int, m.replicaCount)
-	log.Println("Master."+action+" asking replicas to "+action+" tx:", txId, "key:", key)
-	m.forEachReplica(func(i int, r *client.ReplicaClient) {
-		success, err := f(r, txId, i, getReplicaDeath(replicaDeaths, i))
+func (m *Master) mutate(operation common.Operation, key string, value string, masterDeath common.MasterDeath, replicaDeaths []common.ReplicaDeath, f func(r *client.ReplicaClient, txId string, i int, rd common.ReplicaDeath) (*bool, error)) (err error) {
+	action := operation.String()
+	groups := m.writeGroupsOf(key)
+	var down []int
+	for _, g := range groups {
+		_, d, err := m.quorumReplicas(g)
 		if err != nil {
-			log.Println("Master."+action+" r.Try"+action+":", err)
+			return err
 		}
-		if success == nil || !*success {
-			shouldAbort <- 1
-		}
-	})
+		down = append(down, d...)
+	}
+	txId, err := m.begin(action, groups, down)
+	if err != nil {
+		return
+	}
+	defer m.finish(txId)
 
-	// If at least one replica needed to abort
-	select {
-	case <-shouldAbort:
+	if !slices.Equal(m.writeGroupsOf(key), groups) {
+		// A rebalance started or cut over while we waited
+		m.abort(action, txId)
+		return movedError
+	}
+
+	err = m.lockAncestors(txId, key, lock.IntentionExclusive)
+	if err == nil {
+		err = m.admit(txId, key)
+	}
+	if err != nil {
+		log.Println("Master."+action+" unable to lock key:", key, "in tx:", txId, err)
+		m.abort(action, txId)
+		return TxAbortedError
+	}
+
+	log.Println("Master."+action+" asking replicas to "+action+" tx:", txId, "key:", key)
+	nums := m.replicasOf(groups)
+	v, err := m.vote(without(nums, down), action, txId, replicaDeaths, f)
+	if err != nil || !m.accepted(v, groups) {
 		log.Println("Master."+action+" asking replicas to abort tx:", txId, "key:", key)
-		m.log.WriteState(txId, common.Aborted)
-		m.txs[txId] = common.Aborted
-		m.SendAbort(action, txId)
+		m.abort(action, txId)
 		return TxAbortedError
-	default:
-		break
 	}
 
 	// The transaction is now officially committed
 	//TODO: understand this part.
 	m.dieIf(masterDeath, common.MasterDieBeforeLoggingCommitted)
-	m.log.WriteState(txId, common.Committed)
+	err = m.commit(txId)
+	if err != nil {
+		// The decision isn't durable, so it is still ours to change
+		log.Println("Master."+action+" unable to commit, asking replicas to abort tx:", txId, "key:", key, err)
+		m.abort(action, txId)
+		return TxAbortedError
+	}
 	m.dieIf(masterDeath, common.MasterDieAfterLoggingCommitted)
-	m.txs[txId] = common.Committed
 
 	log.Println("Master."+action+" asking replicas to commit tx:", txId, "key:", key)
-	m.SendAndWaitForCommit(action, txId, replicaDeaths)
+	m.forReplicas(v.yes, func(i int, r *client.ReplicaClient) {
+		m.sendAndWaitForCommit(action, txId, r, getReplicaDeath(replicaDeaths, i))
+	})
+
+	if missed := without(nums, v.yes); len(missed) > 0 {
+		m.mu.Lock()
+		commitTs := m.commitTs[txId]
+		m.mu.Unlock()
+		m.addHints(missed, client.KeyVersion{Key: key, CommitTs: commitTs, Value: value, Deleted: operation == common.DelOp})
+	}
+	return nil
+}
 
+// begin logs the start of a new tx on the replicas of groups but those in
+// skip, so that recovery aborts it there if we crash before deciding. Once it
+// succeeds, the caller must call finish after sending the outcome. A tx waits
+// here while the participants change.
+func (m *Master) begin(action string, groups []int, skip []int) (txId string, err error) {
+	if m.log.Degraded() {
+		return "", ReadOnlyError
+	}
+	m.mu.Lock()
+	for m.reconfiguring {
+		m.reconfigured.Wait()
+	}
+	m.active++
+	txId = m.timestamp()
+	nums := without(m.replicasIn(groups), skip)
+	m.mu.Unlock()
+	err = m.log.WriteStart(txId, nums)
+	if err != nil {
+		log.Println("Master."+action+" unable to log start of tx:", txId, err)
+		m.finish(txId)
+		return
+	}
+	replicas := make(map[int]bool)
+	for _, i := range nums {
+		replicas[i] = true
+	}
+	m.mu.Lock()
+	m.txs[txId] = common.Started
+	m.txReplicas[txId] = replicas
+	m.mu.Unlock()
+	return
+}
+
+// finish marks the end of a tx begun with begin.
+func (m *Master) finish(txId string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.active--
+	delete(m.txReplicas, txId)
+}
+
+// timestamp returns a tx id or commit timestamp later than any before it, so
+// timestamps order txs even when the clock doesn't move between calls. It
+// must be called with mu held.
+func (m *Master) timestamp() string {
+	ts := time.Now().UnixNano()
+	if ts <= m.lastTs {
+		ts = m.lastTs + 1
+	}
+	m.lastTs = ts
+	return strconv.FormatInt(ts, 10)
+}
+
+// observeTimestamp makes sure timestamps handed out after recovery are later
+// than ts, even if the clock went back.
+func (m *Master) observeTimestamp(ts string) {
+	if n, err := strconv.ParseInt(ts, 10, 64); err == nil && n > m.lastTs {
+		m.lastTs = n
+	}
+}
+
+// prepare sends one write of txId to the replicas in nums in parallel and
+// reports whether all of them voted yes.
+func (m *Master) prepare(nums []int, action string, txId string, replicaDeaths []common.ReplicaDeath, f func(r *client.ReplicaClient, txId string, i int, rd common.ReplicaDeath) (*bool, error)) bool {
+	v, err := m.vote(nums, action, txId, replicaDeaths, f)
+	return err == nil && QuorumAll.accepts(v, len(nums))
+}
+
+// commit logs the decision to commit txId, unless it was aborted while the
+// replicas voted, e.g. as a deadlock victim. The tx becomes visible to
+// snapshots taken after its commit timestamp.
+func (m *Master) commit(txId string) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.txs[txId] != common.Started {
+		return TxAbortedError
+	}
+	commitTs := m.timestamp()
+	err = m.log.WriteCommit(txId, commitTs)
+	if err != nil {
+		return
+	}
+	m.txs[txId] = common.Committed
+	m.commitTs[txId] = commitTs
+	// The replicas keep the keys locked until they applied the tx
+	m.pathLocks.UnlockAll(txId)
+	return nil
+}
+
+// abort aborts txId on its replicas, unless it was decided otherwise
+// meanwhile, and reports whether this call aborted it. An interactive tx ends
+// here as well, since its client may never call again to find out.
+func (m *Master) abort(action string, txId string) (aborted bool) {
+	state, aborted := m.decideAbort(action, txId)
+	if state != common.Aborted {
+		log.Println("Master."+action+" not aborting tx:", txId, "in state:", state)
+		return
+	}
+	m.SendAbort(action, txId)
+	if m.endSession(txId) {
+		m.finish(txId)
+	}
+	return
+}
+
+// decideAbort records that txId aborted, unless it was already decided. It
+// returns the state the tx ends up in and whether this call aborted it; a
+// committed tx must not be aborted on its replicas.
+func (m *Master) decideAbort(action string, txId string) (state common.TxState, aborted bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.txs[txId] == common.Started {
+		err := m.log.WriteState(txId, common.Aborted)
+		if err != nil {
+			log.Println("Master."+action+" unable to log abort of tx:", txId, err)
+		}
+		m.txs[txId] = common.Aborted
+		aborted = true
+	}
+	state = m.txs[txId]
+	if state != common.Committed {
+		m.pathLocks.Cancel(txId)
+		m.pathLocks.UnlockAll(txId)
+	}
 	return
 }
 
 func (m *Master) SendAbort(action string, txId string) {
-	m.forEachReplica(func(i int, r *client.ReplicaClient) {
+	m.forReplicas(m.participantsOf(txId), func(i int, r *client.ReplicaClient) {
 		_, err := r.Abort(txId)
 		if err != nil {
 			log.Println("Master."+action+" r.Abort:", err)
@@ -79,32 +250,71 @@ func (m *Master) SendAbort(action string, txId string) {
 }
 
 func (m *Master) SendAndWaitForCommit(action string, txId string, replicaDeaths []common.ReplicaDeath) {
-	m.forEachReplica(func(i int, r *client.ReplicaClient) {
-		count := 0
-		for {
-			_, err := r.Commit(txId, getReplicaDeath(replicaDeaths, i))
-			if err == nil {
-				break
-			}
-			log.Println("Master."+action+" r.Commit:", err)
-			time.Sleep(100 * time.Millisecond)
+	m.forReplicas(m.participantsOf(txId), func(i int, r *client.ReplicaClient) {
+		m.sendAndWaitForCommit(action, txId, r, getReplicaDeath(replicaDeaths, i))
+	})
+}
 
-			count++
-			if count > 10 {
-				break
-			}
+func (m *Master) sendAndWaitForCommit(action string, txId string, r *client.ReplicaClient, rd common.ReplicaDeath) {
+	m.mu.Lock()
+	commitTs := m.commitTs[txId]
+	m.mu.Unlock()
+
+	count := 0
+	for {
+		_, err := r.Commit(txId, commitTs, rd)
+		if err == nil {
+			break
 		}
-	})
+		log.Println("Master."+action+" r.Commit:", err)
+		time.Sleep(100 * time.Millisecond)
+
+		count++
+		if count > 10 {
+			break
+		}
+	}
 }
 
 func (m *Master) forEachReplica(f func(i int, r *client.ReplicaClient)) {
+	m.forReplicas(m.allReplicas(), f)
+}
+
+// allReplicas lists the ids of the participants.
+func (m *Master) allReplicas() (nums []int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, r := range m.replicas {
+		if r != nil {
+			nums = append(nums, i)
+		}
+	}
+	return
+}
+
+func (m *Master) replica(num int) (r *client.ReplicaClient, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if num < 0 || num >= len(m.replicas) || m.replicas[num] == nil {
+		return nil, errors.New(fmt.Sprint(NotParticipantError, ": ", num))
+	}
+	return m.replicas[num], nil
+}
+
+func (m *Master) forReplicas(nums []int, f func(i int, r *client.ReplicaClient)) {
 	var wg sync.WaitGroup
-	wg.Add(m.replicaCount)
-	for i := 0; i < m.replicaCount; i++ {
+	for _, i := range nums {
+		r, err := m.replica(i)
+		if err != nil {
+			continue
+		}
+		wg.Add(1)
 		go func(i int, r *client.ReplicaClient) {
 			defer wg.Done()
 			f(i, r)
-		}(i, m.replicas[i])
+		}(i, r)
 	}
 	wg.Wait()
 }
@@ -112,7 +322,7 @@ func (m *Master) forEachReplica(f func(i int, r *client.ReplicaClient)) {
 func (m *Master) dieIf(actual common.MasterDeath, expected common.MasterDeath) {
 	if !m.didSuicide && actual == expected {
 		log.Println("Killing self as requested at", expected)
-		m.log.WriteSpecial(common.KilledSelfMarker)
+		_ = m.log.WriteSpecial(common.KilledSelfMarker)
 		os.Exit(1)
 	}
 }
@@ -134,24 +344,51 @@ func (m *Master) Recover() (err error) {
 			continue
 		}
 
-		m.txs[entry.TxId] = entry.State
+		if state, ok := m.txs[entry.TxId]; !ok || entry.State != common.Started {
+			m.txs[entry.TxId] = entry.State
+		} else if state != common.Started {
+			// More participants, logged as the tx was decided, see involve
+			log.Println("Master.Recover participants of tx:", entry.TxId, "logged after it", state.String())
+		}
+		m.observeTimestamp(entry.TxId)
+		if entry.State == common.Started && entry.Key != "" {
+			participants, err := io.ParseParticipants(entry.Key)
+			if err != nil {
+				return err
+			}
+			if m.txReplicas[entry.TxId] == nil {
+				m.txReplicas[entry.TxId] = make(map[int]bool)
+			}
+			for _, i := range participants {
+				m.txReplicas[entry.TxId][i] = true
+			}
+		}
+		if entry.State == common.Committed {
+			m.commitTs[entry.TxId] = entry.Key
+			m.observeTimestamp(entry.Key)
+		}
 	}
 
 	for txId, state := range m.txs {
 		switch state {
-		case common.Started, common.Aborted:
+		case common.Started:
+			log.Println("Aborting tx", txId, "during recovery.")
+			m.abort("Recover", txId)
+		case common.Aborted:
 			log.Println("Aborting tx", txId, "during recovery.")
 			m.SendAbort("Recover", txId)
 		case common.Committed:
 			log.Println("Committing tx", txId, "during recovery.")
-			m.SendAndWaitForCommit("Recover", txId, make([]common.ReplicaDeath, m.replicaCount))
+			m.SendAndWaitForCommit("Recover", txId, nil)
 		default:
 			panic("unhandled default case")
 		}
 	}
+	// Every outcome went out to the participants logged with the start
+	m.txReplicas = make(map[string]map[int]bool)
 
 	if m.didSuicide {
-		m.log.WriteSpecial(common.FirstRestartAfterSuicideMarker)
+		err = m.log.WriteSpecial(common.FirstRestartAfterSuicideMarker)
 	}
 	return
 }
@@ -164,19 +401,26 @@ func getReplicaDeath(replicaDeaths []common.ReplicaDeath, n int) common.ReplicaD
 	return rd
 }
 
-func RunMaster(replicaCount int) {
-	if replicaCount <= 0 {
+func RunMaster(cluster *common.ClusterConfig, opts Options) {
+	if len(cluster.Replicas) <= 0 {
 		log.Fatalln("Replica count must be greater than 0.")
 	}
 
-	master := NewMaster(replicaCount)
+	master := NewMaster(cluster, opts)
 	err := master.Recover()
 	if err != nil {
 		log.Fatal("Error during recovery: ", err)
 	}
 
+	go master.detectDeadlocks()
+	go master.renewLeases()
+	go master.detectFailures()
+	go master.abortIdleSessions()
+	go master.runAntiEntropy()
+	go master.runHintedHandoff()
+
 	server := rpc.NewServer()
 	_ = server.Register(master)
-	log.Println("Master listening on port", common.MasterPort)
-	_ = http.ListenAndServe(common.MasterPort, server)
+	log.Println("Master listening on", cluster.Master.Listen)
+	_ = http.ListenAndServe(cluster.Master.Listen, server)
 }
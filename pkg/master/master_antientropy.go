@@ -0,0 +1,220 @@
+package master
+
+import (
+	"bytes"
+	"log"
+	"sync"
+	"time"
+	"twopc/pkg/client"
+	"twopc/pkg/common"
+	"twopc/pkg/merkle"
+)
+
+// antiEntropyInterval is how often replicas are compared. A commit that never
+// reached a replica, e.g. because SendAndWaitForCommit gave up on it, is
+// repaired within that time.
+const antiEntropyInterval = 10 * time.Second
+
+func (m *Master) runAntiEntropy() {
+	for {
+		time.Sleep(antiEntropyInterval)
+		m.antiEntropy()
+	}
+}
+
+// antiEntropy compares the Merkle trees of the live participants of each
+// group and brings every key they disagree on up to its latest version. Only
+// versions the master logged as committed are spread, so nothing a replica
+// applied on its own makes it to the others.
+func (m *Master) antiEntropy() (repaired int) {
+	live := m.liveReplicas()
+	for _, g := range m.allGroups() {
+		var nums []int
+		for _, i := range live {
+			if m.groupOf(i) == g {
+				nums = append(nums, i)
+			}
+		}
+		repaired += m.antiEntropyGroup(g, nums)
+	}
+	return
+}
+
+// antiEntropyGroup repairs the live replicas of group g.
+func (m *Master) antiEntropyGroup(g int, live []int) (repaired int) {
+	trees := m.merkleTrees(live)
+	nums := sortedInts(trees)
+	if len(nums) < 2 {
+		return 0
+	}
+
+	differ := make(map[int]bool)
+	for _, i := range nums[1:] {
+		for _, b := range merkle.Diff(trees[nums[0]], trees[i]) {
+			differ[b] = true
+		}
+	}
+	if len(differ) == 0 {
+		return 0
+	}
+	log.Println("Master.antiEntropy replicas", nums, "of group", g, "differ in", len(differ), "buckets")
+
+	committed := m.committedTimestamps()
+	for _, b := range sortedInts(differ) {
+		repaired += m.repairBucket(nums, b, committed)
+	}
+	log.Println("Master.antiEntropy repaired", repaired, "keys in group", g)
+	return
+}
+
+// merkleTrees fetches the Merkle trees of the replicas in nums that answer.
+func (m *Master) merkleTrees(nums []int) map[int]*merkle.Tree {
+	trees := make(map[int]*merkle.Tree)
+	var mu sync.Mutex
+	m.forReplicas(nums, func(i int, r *client.ReplicaClient) {
+		tree, err := r.MerkleTree()
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		trees[i] = tree
+	})
+	return trees
+}
+
+// catchUp repairs stale replica num from the other live replicas of its
+// group, and clears its mark once its Merkle tree matches all of theirs.
+// Until then it is tried again every hintReplayInterval.
+func (m *Master) catchUp(num int) (caughtUp bool) {
+	g := m.groupOf(num)
+	var nums []int
+	for _, i := range m.liveReplicas() {
+		if m.groupOf(i) == g {
+			nums = append(nums, i)
+		}
+	}
+	m.antiEntropyGroup(g, nums)
+
+	trees := m.merkleTrees(nums)
+	if trees[num] == nil || len(trees) < 2 {
+		return false
+	}
+	for i, tree := range trees {
+		if i != num && len(merkle.Diff(trees[num], tree)) > 0 {
+			return false
+		}
+	}
+
+	m.mu.Lock()
+	delete(m.stale, num)
+	if len(m.hints[num]) == 0 {
+		m.saveHinted()
+	}
+	m.mu.Unlock()
+	log.Println("Master.catchUp replica", num, "is up to date again")
+	return true
+}
+
+// repairBucket compares the keys of one bucket across replicas nums.
+func (m *Master) repairBucket(nums []int, bucket int, committed map[string]bool) (repaired int) {
+	digests := make(map[string]map[int]client.KeyDigest)
+	var mu sync.Mutex
+	m.forReplicas(nums, func(i int, r *client.ReplicaClient) {
+		keys, err := r.MerkleBucket(bucket)
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, d := range keys {
+			if digests[d.Key] == nil {
+				digests[d.Key] = make(map[int]client.KeyDigest)
+			}
+			digests[d.Key][i] = d
+		}
+	})
+
+	for _, key := range sortedKeys(digests) {
+		source, ok := latest(digests[key], committed)
+		if !ok {
+			continue
+		}
+		want := digests[key][source]
+
+		var v *client.KeyVersion
+		for _, i := range nums {
+			d, has := digests[key][i]
+			if has && d.CommitTs == want.CommitTs {
+				if !bytes.Equal(d.ValueHash, want.ValueHash) || d.Deleted != want.Deleted {
+					log.Println("Master.antiEntropy replicas", source, "and", i, "differ on key:", key, "at the same version:", want.CommitTs)
+				}
+				continue
+			}
+			if has && common.TxOlder(want.CommitTs, d.CommitTs) {
+				// Newer than anything committed, left for a human to look at
+				continue
+			}
+			if v == nil {
+				var err error
+				v, err = m.latestVersion(source, key)
+				if err != nil || v.CommitTs != want.CommitTs {
+					break
+				}
+			}
+			r, err := m.replica(i)
+			if err != nil {
+				continue
+			}
+			success, err := r.Repair(v)
+			if err == nil && *success {
+				log.Println("Master.antiEntropy repaired key:", key, "on replica:", i, "to version:", v.CommitTs, "from replica:", source)
+				repaired++
+			}
+		}
+	}
+	return
+}
+
+// latest picks the replica with the newest committed version of a key.
+func latest(digests map[int]client.KeyDigest, committed map[string]bool) (source int, ok bool) {
+	for _, i := range sortedInts(digests) {
+		d := digests[i]
+		if d.CommitTs != "" && !committed[d.CommitTs] {
+			log.Println("Master.antiEntropy replica", i, "has key:", d.Key, "at version:", d.CommitTs, "which never committed")
+			continue
+		}
+		if !ok || common.TxOlder(digests[source].CommitTs, d.CommitTs) {
+			source, ok = i, true
+		}
+	}
+	return
+}
+
+func (m *Master) latestVersion(num int, key string) (v *client.KeyVersion, err error) {
+	r, err := m.replica(num)
+	if err != nil {
+		return
+	}
+	return r.LatestVersion(key)
+}
+
+// committedTimestamps returns the commit timestamp of every committed tx.
+// Those committed before commit timestamps existed commit at their id.
+func (m *Master) committedTimestamps() map[string]bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	committed := make(map[string]bool)
+	for txId, state := range m.txs {
+		if state != common.Committed {
+			continue
+		}
+		if ts := m.commitTs[txId]; ts != "" {
+			committed[ts] = true
+		} else {
+			committed[txId] = true
+		}
+	}
+	return committed
+}
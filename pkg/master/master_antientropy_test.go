@@ -0,0 +1,30 @@
+package master
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"twopc/pkg/client"
+)
+
+func TestLatestPicksNewestCommittedVersion(t *testing.T) {
+	committed := map[string]bool{"10": true, "20": true}
+	digests := map[int]client.KeyDigest{
+		0: {Key: "k", CommitTs: "10"},
+		1: {Key: "k", CommitTs: "20"},
+		// Never committed, so it can't be the source
+		2: {Key: "k", CommitTs: "30"},
+	}
+
+	source, ok := latest(digests, committed)
+	assert.True(t, ok)
+	assert.Equal(t, 1, source)
+}
+
+func TestLatestAcceptsLegacyVersions(t *testing.T) {
+	source, ok := latest(map[int]client.KeyDigest{1: {Key: "k"}}, map[string]bool{})
+	assert.True(t, ok)
+	assert.Equal(t, 1, source)
+
+	_, ok = latest(map[int]client.KeyDigest{1: {Key: "k", CommitTs: "5"}}, map[string]bool{})
+	assert.False(t, ok)
+}
@@ -2,10 +2,13 @@ package master
 
 import (
 	"log"
-	"math/rand"
+	"path"
+	"sync"
 	"twopc/pkg/client"
 	"twopc/pkg/common"
 	"twopc/pkg/io"
+	"twopc/pkg/lock"
+	"twopc/pkg/ring"
 )
 
 type MasterRpcAPI interface {
@@ -14,29 +17,150 @@ type MasterRpcAPI interface {
 	Del(args *client.DelArgs, _ *int) (err error)
 	Status(args *client.StatusArgs, reply *client.StatusResult) (err error)
 	Ping(args *client.PingArgs, reply *client.GetResult) (err error)
+	ReportWaitFor(args *client.WaitForArgs, _ *int) (err error)
+	DeadlockStats(args *client.DeadlockStatsArgs, reply *client.DeadlockStatsResult) (err error)
+	Wound(args *client.TxArgs, _ *int) (err error)
+	Locks(args *client.LocksArgs, reply *client.LocksResult) (err error)
+	Heartbeat(args *client.HeartbeatArgs, reply *client.HeartbeatResult) (err error)
+	Membership(args *client.MembershipArgs, reply *client.MembershipResult) (err error)
+}
+
+// Options tune the master. The zero value needs every replica to commit.
+type Options struct {
+	// WriteQuorum is how many replicas of a group must vote yes for a Put or
+	// Del to commit. Interactive and optimistic txs always need all of them.
+	WriteQuorum WriteQuorum
+	// ReadPolicy picks the replica each read goes to. PinnedReplicas are
+	// preferred, in order, under Pinned.
+	ReadPolicy     ReadPolicy
+	PinnedReplicas []int
 }
 
 type Master struct {
-	replicaCount int
-	replicas     []*client.ReplicaClient
-	log          *io.Logger
-	txs          map[string]common.TxState
-	didSuicide   bool
+	// mu guards txs, so a tx can't be both committed by Mutate and aborted
+	// as a deadlock victim.
+	mu sync.Mutex
+	// lastTs is the last timestamp handed out, as tx id or commit timestamp.
+	lastTs int64
+
+	// replicas is indexed by replica id, with nil for ids that are not
+	// participants. It only changes while no tx is running, see AddReplica.
+	replicas []*client.ReplicaClient
+	// groups maps participants to the replica group they belong to, and
+	// shards maps keys to the group holding them. Every group keeps at
+	// least one participant.
+	groups map[int]int
+	shards *placement
+	// txReplicas maps running txs to the replicas they hold state on.
+	txReplicas map[string]map[int]bool
+	// hints keeps the committed writes each replica missed under a
+	// writeQuorum short of all, oldest first, until they are replayed to it.
+	writeQuorum WriteQuorum
+	hints       map[int][]client.KeyVersion
+	// stale marks replicas that lost some of their hints, because there were
+	// too many or an earlier master kept them. catchUp repairs them.
+	// hintedPath lists the replicas with hints or marked stale.
+	stale      map[int]bool
+	hintedPath string
+	// joined maps replicas added at runtime to the timestamp they joined at.
+	joined map[int]string
+	// participantsPath is where the participant set is kept once it changed.
+	participantsPath string
+	// incarnations maps participants to the copy of their data they run
+	// with, see checkIncarnation. rebuilding marks those being rebuilt.
+	incarnations     map[int]string
+	incarnationsPath string
+	rebuilding       map[int]bool
+	// active counts txs between begin and sending their outcome. While
+	// reconfiguring, new txs wait on reconfigured.
+	active        int
+	reconfiguring bool
+	reconfigured  *sync.Cond
+
+	log        *io.Logger
+	txs        map[string]common.TxState
+	commitTs   map[string]string
+	didSuicide bool
+	deadlocks  *deadlockDetector
+	sessions   map[string]*session
+	// pathLocks is the central lock table for namespaces and tables. Keys
+	// are locked on the replicas, and here only while one-shot mutations
+	// wait their turn.
+	pathLocks *lock.Manager
+	members   *membership
+	// router picks the replica each read goes to.
+	router *router
 }
 
-func NewMaster(replicaCount int) *Master {
-	l := io.NewLogger("logs/master.txt")
-	replicas := make([]*client.ReplicaClient, replicaCount)
-	for i := 0; i < replicaCount; i++ {
-		replicas[i] = client.NewReplicaClient(client.GetReplicaHost(i))
+func NewMaster(cluster *common.ClusterConfig, opts Options) *Master {
+	l := io.NewLogger(path.Join(cluster.Master.LogDir, "master.txt"))
+	participantsPath := path.Join(cluster.Master.LogDir, participantsFile)
+	participants, err := loadParticipants(participantsPath, cluster)
+	if err != nil {
+		log.Fatalln("newMaster:", err)
+	}
+	shardsPath := path.Join(cluster.Master.LogDir, shardsFile)
+	moves, err := loadMoves(shardsPath)
+	if err != nil {
+		log.Fatalln("newMaster:", err)
+	}
+	incarnationsPath := path.Join(cluster.Master.LogDir, incarnationsFile)
+	incarnations, err := loadIncarnations(incarnationsPath)
+	if err != nil {
+		log.Fatalln("newMaster:", err)
+	}
+	hintedPath := path.Join(cluster.Master.LogDir, hintedFile)
+	stale, err := loadHinted(hintedPath)
+	if err != nil {
+		log.Fatalln("newMaster:", err)
+	}
+	var replicas []*client.ReplicaClient
+	var nums []int
+	groups := make(map[int]int)
+	joined := make(map[int]string)
+	for _, p := range participants {
+		replicas = growReplicas(replicas, p.Id)
+		replicas[p.Id] = client.NewReplicaClient(p.Address)
+		nums = append(nums, p.Id)
+		groups[p.Id] = p.Group
+		if p.Since != "" {
+			joined[p.Id] = p.Since
+		}
 	}
-	return &Master{
-		replicaCount: replicaCount,
-		replicas:     replicas,
-		log:          l,
-		txs:          make(map[string]common.TxState),
-		didSuicide:   false,
+	err = checkRingGroups(path.Join(cluster.Master.LogDir, ringFile), groupsIn(groups))
+	if err != nil {
+		log.Fatalln("newMaster:", err)
+	}
+	m := &Master{
+		replicas:         replicas,
+		groups:           groups,
+		shards:           newPlacement(ring.New(groupsIn(groups)), moves, shardsPath),
+		txReplicas:       make(map[string]map[int]bool),
+		writeQuorum:      opts.WriteQuorum,
+		hints:            make(map[int][]client.KeyVersion),
+		stale:            stale,
+		hintedPath:       hintedPath,
+		router:           newRouter(opts.ReadPolicy, opts.PinnedReplicas),
+		joined:           joined,
+		participantsPath: participantsPath,
+		incarnations:     incarnations,
+		incarnationsPath: incarnationsPath,
+		rebuilding:       make(map[int]bool),
+		log:              l,
+		txs:              make(map[string]common.TxState),
+		commitTs:         make(map[string]string),
+		didSuicide:       false,
+		deadlocks:        newDeadlockDetector(),
+		sessions:         make(map[string]*session),
+		pathLocks:        lock.NewManager(),
+		members:          newMembership(nums),
+	}
+	m.reconfigured = sync.NewCond(&m.mu)
+	for _, since := range joined {
+		// Txs after a restart must still count as later than the join
+		m.observeTimestamp(since)
 	}
+	return m
 }
 
 func (m *Master) Get(args *client.GetArgs, reply *client.GetResult) (err error) {
@@ -45,12 +169,29 @@ func (m *Master) Get(args *client.GetArgs, reply *client.GetResult) (err error)
 
 func (m *Master) GetTest(args *client.GetTestArgs, reply *client.GetResult) (err error) {
 	log.Println("Master.Get is being called")
+	owner, err := m.lockReadAncestors(args.Key)
+	if err != nil {
+		log.Println("Master.Get unable to lock parents of key:", args.Key, err)
+		return
+	}
+	defer m.pathLocks.UnlockAll(owner)
+
 	rn := args.ReplicaNum
 	if rn < 0 {
-		// TODO: Sharding logic.
-		rn = rand.Intn(m.replicaCount)
+		rn, err = m.pickReplica(m.shardOf(args.Key))
+		if err != nil {
+			return
+		}
+	}
+	rc, err := m.replica(rn)
+	if err != nil {
+		return
 	}
-	r, err := m.replicas[rn].Get(args.Key)
+	var r *string
+	err = m.read(rn, func() (err error) {
+		r, err = rc.Get(args.Key)
+		return
+	})
 	if err != nil {
 		log.Printf("Master.Get: request to replica %v for key %v failed\n", rn, args.Key)
 		return
@@ -61,13 +202,14 @@ func (m *Master) GetTest(args *client.GetTestArgs, reply *client.GetResult) (err
 
 func (m *Master) Put(args *client.PutArgs, _ *int) (err error) {
 	var i int
-	return m.PutTest(&client.PutTestArgs{Key: args.Key, Value: args.Value, MasterDeath: common.MasterDontDie, ReplicaDeaths: make([]common.ReplicaDeath, m.replicaCount)}, &i)
+	return m.PutTest(&client.PutTestArgs{Key: args.Key, Value: args.Value, MasterDeath: common.MasterDontDie, ReplicaDeaths: nil}, &i)
 }
 
 func (m *Master) PutTest(args *client.PutTestArgs, _ *int) (err error) {
 	return m.Mutate(
 		common.PutOp,
 		args.Key,
+		args.Value,
 		args.MasterDeath,
 		args.ReplicaDeaths,
 		func(r *client.ReplicaClient, txId string, i int, rd common.ReplicaDeath) (*bool, error) {
@@ -77,13 +219,14 @@ func (m *Master) PutTest(args *client.PutTestArgs, _ *int) (err error) {
 
 func (m *Master) Del(args *client.DelArgs, _ *int) (err error) {
 	var i int
-	return m.DelTest(&client.DelTestArgs{Key: args.Key, MasterDeath: common.MasterDontDie, ReplicaDeaths: make([]common.ReplicaDeath, m.replicaCount)}, &i)
+	return m.DelTest(&client.DelTestArgs{Key: args.Key, MasterDeath: common.MasterDontDie, ReplicaDeaths: nil}, &i)
 }
 
 func (m *Master) DelTest(args *client.DelTestArgs, _ *int) (err error) {
 	return m.Mutate(
 		common.DelOp,
 		args.Key,
+		"",
 		args.MasterDeath,
 		args.ReplicaDeaths,
 		func(r *client.ReplicaClient, txId string, i int, rd common.ReplicaDeath) (*bool, error) {
@@ -92,11 +235,15 @@ func (m *Master) DelTest(args *client.DelTestArgs, _ *int) (err error) {
 }
 
 func (m *Master) Status(args *client.StatusArgs, reply *client.StatusResult) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	state, ok := m.txs[args.TxId]
 	if !ok {
 		state = common.NoState
 	}
 	reply.State = state
+	reply.CommitTs = m.commitTs[args.TxId]
 	return nil
 }
 
@@ -0,0 +1,184 @@
+package master
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+	"twopc/pkg/client"
+	"twopc/pkg/common"
+)
+
+const deadlockCheckInterval = 200 * time.Millisecond
+
+// deadlockDetector keeps the latest wait-for edges of every replica. Their
+// union is the global wait-for graph; a cycle in it is a deadlock no single
+// replica can see.
+type deadlockDetector struct {
+	mu             sync.Mutex
+	reports        map[int][]client.WaitForEdge
+	cyclesDetected int
+	victimsAborted int
+	lastCycle      []string
+	wounded        int
+}
+
+func newDeadlockDetector() *deadlockDetector {
+	return &deadlockDetector{reports: make(map[int][]client.WaitForEdge)}
+}
+
+func (m *Master) ReportWaitFor(args *client.WaitForArgs, _ *int) (err error) {
+	m.deadlocks.mu.Lock()
+	defer m.deadlocks.mu.Unlock()
+
+	m.deadlocks.reports[args.ReplicaNum] = args.Edges
+	return nil
+}
+
+func (m *Master) DeadlockStats(args *client.DeadlockStatsArgs, reply *client.DeadlockStatsResult) (err error) {
+	m.deadlocks.mu.Lock()
+	defer m.deadlocks.mu.Unlock()
+
+	reply.CyclesDetected = m.deadlocks.cyclesDetected
+	reply.VictimsAborted = m.deadlocks.victimsAborted
+	reply.LastCycle = m.deadlocks.lastCycle
+	reply.Wounded = m.deadlocks.wounded
+	return nil
+}
+
+// Wound aborts a tx on behalf of an older one that needs its locks, as
+// replicas running wound-wait do. A tx that is already decided is left alone.
+func (m *Master) Wound(args *client.TxArgs, _ *int) (err error) {
+	log.Println("Master.Wound aborting tx:", args.TxId)
+	if m.abort("Wound", args.TxId) {
+		m.deadlocks.mu.Lock()
+		m.deadlocks.wounded++
+		m.deadlocks.mu.Unlock()
+	}
+	return nil
+}
+
+func (m *Master) detectDeadlocks() {
+	for {
+		time.Sleep(deadlockCheckInterval)
+		m.resolveDeadlocks()
+	}
+}
+
+// resolveDeadlocks aborts the youngest tx of every cycle in the global
+// wait-for graph until no cycle is left.
+func (m *Master) resolveDeadlocks() {
+	graph := m.waitForGraph()
+	for {
+		cycle := findCycle(graph)
+		if cycle == nil {
+			return
+		}
+		victim := youngest(cycle)
+		log.Println("Deadlock detected between", cycle, "aborting tx:", victim)
+
+		// The victim may have committed since the graph was built
+		aborted := m.abort("Deadlock", victim)
+		m.deadlocks.mu.Lock()
+		m.deadlocks.cyclesDetected++
+		if aborted {
+			m.deadlocks.victimsAborted++
+		}
+		m.deadlocks.lastCycle = cycle
+		m.deadlocks.mu.Unlock()
+
+		delete(graph, victim)
+		for _, holders := range graph {
+			delete(holders, victim)
+		}
+	}
+}
+
+// waitForGraph merges the replica reports, keeping only txs that are still
+// undecided. A decided tx is on its way to releasing its locks.
+func (m *Master) waitForGraph() (graph map[string]map[string]bool) {
+	m.deadlocks.mu.Lock()
+	var edges []client.WaitForEdge
+	for _, report := range m.deadlocks.reports {
+		edges = append(edges, report...)
+	}
+	m.deadlocks.mu.Unlock()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	graph = make(map[string]map[string]bool)
+	for _, e := range edges {
+		if m.txs[e.Waiter] != common.Started || m.txs[e.Holder] != common.Started {
+			continue
+		}
+		if graph[e.Waiter] == nil {
+			graph[e.Waiter] = make(map[string]bool)
+		}
+		graph[e.Waiter][e.Holder] = true
+	}
+	return
+}
+
+// findCycle returns the txs of some cycle in graph, or nil if there is none.
+func findCycle(graph map[string]map[string]bool) []string {
+	const (
+		unvisited = iota
+		onStack
+		done
+	)
+	state := make(map[string]int)
+	var stack []string
+
+	var visit func(txId string) []string
+	visit = func(txId string) []string {
+		state[txId] = onStack
+		stack = append(stack, txId)
+		for _, next := range sortedKeys(graph[txId]) {
+			switch state[next] {
+			case onStack:
+				for i := len(stack) - 1; i >= 0; i-- {
+					if stack[i] == next {
+						return append([]string(nil), stack[i:]...)
+					}
+				}
+			case unvisited:
+				if cycle := visit(next); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[txId] = done
+		return nil
+	}
+
+	for _, txId := range sortedKeys(graph) {
+		if state[txId] == unvisited {
+			if cycle := visit(txId); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
+
+// youngest picks the tx that started last.
+func youngest(txIds []string) string {
+	victim := txIds[0]
+	for _, txId := range txIds[1:] {
+		if common.TxOlder(victim, txId) {
+			victim = txId
+		}
+	}
+	return victim
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,40 @@
+package master
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"twopc/pkg/client"
+	"twopc/pkg/common"
+)
+
+func TestFindCycle(t *testing.T) {
+	graph := map[string]map[string]bool{
+		"100": {"200": true},
+		"200": {"300": true},
+		"300": {"100": true},
+		"400": {"100": true},
+	}
+	cycle := findCycle(graph)
+	assert.ElementsMatch(t, []string{"100", "200", "300"}, cycle)
+	assert.Equal(t, "300", youngest(cycle))
+
+	delete(graph["200"], "300")
+	assert.Nil(t, findCycle(graph))
+}
+
+func TestYoungestComparesIdsNumerically(t *testing.T) {
+	assert.Equal(t, "1000", youngest([]string{"999", "1000", "998"}))
+}
+
+func TestWoundCountsOnlyAbortedTxs(t *testing.T) {
+	m := newSessionMaster(t, "1", "2")
+	m.deadlocks = newDeadlockDetector()
+	m.txs["1"] = common.Committed
+
+	assert.Nil(t, m.Wound(&client.TxArgs{TxId: "1"}, nil))
+	assert.Nil(t, m.Wound(&client.TxArgs{TxId: "2"}, nil))
+	assert.Nil(t, m.Wound(&client.TxArgs{TxId: "2"}, nil))
+	assert.Equal(t, common.Committed, m.txs["1"])
+	assert.Equal(t, common.Aborted, m.txs["2"])
+	assert.Equal(t, 1, m.deadlocks.wounded)
+}
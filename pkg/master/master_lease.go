@@ -0,0 +1,42 @@
+package master
+
+import (
+	"time"
+	"twopc/pkg/client"
+	"twopc/pkg/common"
+)
+
+// leaseRenewInterval must stay well below the replicas' lease duration, or
+// they start asking about txs we are still working on.
+const leaseRenewInterval = time.Second
+
+// renewLeases keeps the locks of undecided txs alive on the replicas. Once a
+// tx is decided its leases are left to run out, so a replica that missed the
+// outcome comes asking for it.
+func (m *Master) renewLeases() {
+	for {
+		time.Sleep(leaseRenewInterval)
+
+		leases := m.undecided()
+		m.forReplicas(sortedInts(leases), func(i int, r *client.ReplicaClient) {
+			_ = r.RenewLeases(leases[i])
+		})
+	}
+}
+
+// undecided maps every replica to the undecided txs it takes part in.
+func (m *Master) undecided() (leases map[int][]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	leases = make(map[int][]string)
+	for txId, state := range m.txs {
+		if state != common.Started {
+			continue
+		}
+		for i := range m.txReplicas[txId] {
+			leases[i] = append(leases[i], txId)
+		}
+	}
+	return
+}
@@ -0,0 +1,139 @@
+package master
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"twopc/pkg/client"
+	"twopc/pkg/lock"
+)
+
+// pathLockTimeout is how long a tx waits for a namespace or table held by
+// someone else, e.g. a migration, before giving up.
+const pathLockTimeout = time.Second
+
+// admissionTimeout is how long a mutation waits in line behind others on the
+// same key. The line moves one two-phase commit at a time.
+const admissionTimeout = 5 * time.Second
+
+// admissionPrefix sets the admission lock of a key apart from the lock of a
+// namespace or table with the same name, which share the lock manager.
+const admissionPrefix = "key:"
+
+// pathSeparator splits a key into namespace, table and key. A key may have any
+// number of levels; one without a separator belongs to no namespace.
+const pathSeparator = "/"
+
+// ancestors returns the namespaces and tables above key, outermost first.
+func ancestors(key string) (paths []string) {
+	parts := strings.Split(key, pathSeparator)
+	for i := 1; i < len(parts); i++ {
+		paths = append(paths, strings.Join(parts[:i], pathSeparator))
+	}
+	return
+}
+
+// lockAncestors takes intent on every namespace and table above key, so that
+// nobody can lock those as a whole while txId works on key.
+func (m *Master) lockAncestors(txId string, key string, intent lock.Mode) (err error) {
+	for _, p := range ancestors(key) {
+		err = m.pathLocks.Lock(txId, p, intent, pathLockTimeout)
+		if err != nil {
+			return
+		}
+	}
+	return nil
+}
+
+// lockReadAncestors takes intent to read on every namespace and table above
+// key for a read outside a tx, so the read waits for whoever locked one of
+// them as a whole. The locks are held under owner until the caller releases
+// them with UnlockAll.
+func (m *Master) lockReadAncestors(key string) (owner string, err error) {
+	m.mu.Lock()
+	owner = m.timestamp()
+	m.mu.Unlock()
+
+	err = m.lockAncestors(owner, key, lock.IntentionShared)
+	if err != nil {
+		m.pathLocks.UnlockAll(owner)
+	}
+	return
+}
+
+// admit puts txId in line behind every other mutation of keys still being
+// decided. Without it concurrent mutations of a key reach the replicas in
+// different orders, each replica lets a different one win and all of them
+// abort. Keys are taken in order so two txs can't hold each other up.
+func (m *Master) admit(txId string, keys ...string) (err error) {
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+	for _, key := range sorted {
+		err = m.pathLocks.Lock(txId, admissionPrefix+key, lock.Exclusive, admissionTimeout)
+		if err != nil {
+			return
+		}
+	}
+	return nil
+}
+
+// LockPath locks a whole namespace or table for an interactive tx, for bulk
+// work such as truncating or migrating it. Txs on other namespaces go on as
+// usual, those touching this one wait until the tx ends.
+func (m *Master) LockPath(args *client.LockPathArgs, _ *int) (err error) {
+	_, err = m.getSession(args.TxId)
+	if err != nil {
+		return
+	}
+
+	mode, intent := lock.Shared, lock.IntentionShared
+	if args.Exclusive {
+		mode, intent = lock.Exclusive, lock.IntentionExclusive
+	}
+	err = m.lockAncestors(args.TxId, args.Path, intent)
+	if err == nil {
+		err = m.pathLocks.Lock(args.TxId, args.Path, mode, pathLockTimeout)
+	}
+	if err != nil {
+		log.Println("Master.LockPath unable to lock:", args.Path, "in tx:", args.TxId, err)
+		m.abortSession("LockPath", args.TxId)
+		return TxAbortedError
+	}
+	log.Println("Master.LockPath locked:", args.Path, mode.String(), "in tx:", args.TxId)
+	return nil
+}
+
+// Locks lists the namespace and table locks kept here together with the key
+// locks of every replica that answers.
+func (m *Master) Locks(args *client.LocksArgs, reply *client.LocksResult) (err error) {
+	locks := m.pathLocks.Locks()
+	m.mu.Lock()
+	for _, l := range locks {
+		reply.Locks = append(reply.Locks, client.LockInfo{
+			Replica: -1,
+			TxId:    l.TxId,
+			Key:     l.Key,
+			Mode:    l.Mode.String(),
+			State:   m.txs[l.TxId],
+			Waiting: l.Waiting,
+			Age:     time.Since(l.Since),
+		})
+	}
+	m.mu.Unlock()
+
+	var mu sync.Mutex
+	m.forEachReplica(func(i int, r *client.ReplicaClient) {
+		locks, err := r.Locks()
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			reply.Unreachable = append(reply.Unreachable, i)
+			return
+		}
+		reply.Locks = append(reply.Locks, locks...)
+	})
+	sort.Ints(reply.Unreachable)
+	return nil
+}
@@ -0,0 +1,36 @@
+package master
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"twopc/pkg/lock"
+)
+
+func TestAncestors(t *testing.T) {
+	assert.Equal(t, []string{"ns", "ns/table"}, ancestors("ns/table/key"))
+	assert.Nil(t, ancestors("key"))
+}
+
+func TestReadsWaitForLockedNamespace(t *testing.T) {
+	m := &Master{pathLocks: lock.NewManager()}
+	assert.Nil(t, m.pathLocks.Lock("1", "ns", lock.Exclusive, pathLockTimeout))
+
+	_, err := m.lockReadAncestors("ns/table/key")
+	assert.NotNil(t, err)
+	owner, err := m.lockReadAncestors("other/table/key")
+	assert.Nil(t, err)
+	m.pathLocks.UnlockAll(owner)
+
+	m.pathLocks.UnlockAll("1")
+	owner, err = m.lockReadAncestors("ns/table/key")
+	assert.Nil(t, err)
+	assert.True(t, m.pathLocks.Holds(owner, "ns/table"))
+}
+
+func TestAdmissionLeavesNamespacesAlone(t *testing.T) {
+	m := &Master{pathLocks: lock.NewManager()}
+	// A key named like a namespace doesn't lock the namespace
+	assert.Nil(t, m.admit("1", "orders"))
+	assert.Nil(t, m.pathLocks.Lock("2", "orders", lock.Exclusive, pathLockTimeout))
+	assert.True(t, m.pathLocks.Holds("1", admissionPrefix+"orders"))
+}
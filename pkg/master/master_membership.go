@@ -0,0 +1,164 @@
+package master
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+	"twopc/pkg/client"
+)
+
+// replicaFailureTimeout is how long a replica may go without a heartbeat
+// before it is considered dead. Replicas send one every half second.
+const replicaFailureTimeout = 2 * time.Second
+
+// maxMembershipEvents is how many membership changes are kept for queries.
+const maxMembershipEvents = 100
+
+// membership is the master's view of which participants are up, built from
+// their heartbeats.
+type membership struct {
+	mu       sync.Mutex
+	lastSeen map[int]time.Time
+	alive    map[int]bool
+	events   []client.MembershipEvent
+}
+
+func newMembership(replicaNums []int) *membership {
+	ms := &membership{
+		lastSeen: make(map[int]time.Time),
+		alive:    make(map[int]bool),
+	}
+	for _, i := range replicaNums {
+		ms.add(i)
+	}
+	return ms
+}
+
+// add starts watching a replica, taking it to be alive: one that never shows
+// up is declared dead once the timeout passed.
+func (ms *membership) add(replicaNum int) {
+	ms.lastSeen[replicaNum] = time.Now()
+	ms.alive[replicaNum] = true
+}
+
+func (ms *membership) remove(replicaNum int) {
+	delete(ms.lastSeen, replicaNum)
+	delete(ms.alive, replicaNum)
+}
+
+func (ms *membership) setAlive(replicaNum int, alive bool) {
+	if ms.alive[replicaNum] == alive {
+		return
+	}
+	ms.alive[replicaNum] = alive
+	if alive {
+		log.Println("Replica", replicaNum, "is up")
+	} else {
+		log.Println("Replica", replicaNum, "is down, last heartbeat", time.Since(ms.lastSeen[replicaNum]).Round(time.Millisecond), "ago")
+	}
+	ms.events = append(ms.events, client.MembershipEvent{Replica: replicaNum, Alive: alive, At: time.Now()})
+	if len(ms.events) > maxMembershipEvents {
+		ms.events = ms.events[len(ms.events)-maxMembershipEvents:]
+	}
+}
+
+func (m *Master) Heartbeat(args *client.HeartbeatArgs, reply *client.HeartbeatResult) (err error) {
+	m.members.mu.Lock()
+	defer m.members.mu.Unlock()
+
+	alive, ok := m.members.alive[args.ReplicaNum]
+	if !ok {
+		return errors.New(fmt.Sprint("Heartbeat from a replica that is not a participant: ", args.ReplicaNum))
+	}
+	if !m.checkIncarnation(args, reply) {
+		return nil
+	}
+	m.members.lastSeen[args.ReplicaNum] = time.Now()
+	if !alive {
+		// It most likely restarted, leaving our connection to it dead
+		if r, err := m.replica(args.ReplicaNum); err == nil {
+			r.Reconnect()
+		}
+	}
+	m.members.setAlive(args.ReplicaNum, true)
+	return nil
+}
+
+func (m *Master) Membership(args *client.MembershipArgs, reply *client.MembershipResult) (err error) {
+	m.members.mu.Lock()
+	defer m.members.mu.Unlock()
+
+	for _, i := range sortedInts(m.members.alive) {
+		latency, errorRate := m.router.snapshot(i)
+		reply.Members = append(reply.Members, client.MemberStatus{
+			Replica:     i,
+			Group:       m.groupOf(i),
+			Hints:       m.pendingHints(i),
+			Alive:       m.members.alive[i],
+			LastSeen:    time.Since(m.members.lastSeen[i]),
+			ReadLatency: latency,
+			ReadErrors:  errorRate,
+		})
+	}
+	reply.Events = append(reply.Events, m.members.events...)
+	return nil
+}
+
+func (m *Master) detectFailures() {
+	for {
+		time.Sleep(replicaFailureTimeout / 4)
+		m.members.expire()
+	}
+}
+
+// expire declares the replicas dead that sent no heartbeat for too long.
+func (ms *membership) expire() {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for i, seen := range ms.lastSeen {
+		if time.Since(seen) > replicaFailureTimeout {
+			ms.setAlive(i, false)
+		}
+	}
+}
+
+func sortedInts[V any](m map[int]V) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+// liveReplicas lists the participants that are up.
+func (m *Master) liveReplicas() (nums []int) {
+	m.members.mu.Lock()
+	defer m.members.mu.Unlock()
+
+	for _, i := range sortedInts(m.members.alive) {
+		if m.members.alive[i] {
+			nums = append(nums, i)
+		}
+	}
+	return
+}
+
+// checkReplicasAlive fails a mutation up front when one of the replicas in
+// nums it needs is known to be down, rather than after waiting for the RPC to
+// fail.
+func (m *Master) checkReplicasAlive(nums []int) (err error) {
+	m.members.mu.Lock()
+	defer m.members.mu.Unlock()
+
+	for _, i := range nums {
+		if alive, ok := m.members.alive[i]; ok && !alive {
+			return errors.New(fmt.Sprint(ReplicaDownError, ": ", i))
+		}
+	}
+	return nil
+}
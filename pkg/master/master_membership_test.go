@@ -0,0 +1,37 @@
+package master
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+	"twopc/pkg/client"
+)
+
+func TestHeartbeatsMarkReplicasDownAndUp(t *testing.T) {
+	m := &Master{
+		members:      newMembership([]int{0, 1}),
+		incarnations: map[int]string{0: "a", 1: "b"},
+		replicas:     []*client.ReplicaClient{client.NewReplicaClient("localhost:1"), client.NewReplicaClient("localhost:1")},
+	}
+	assert.Equal(t, []int{0, 1}, m.liveReplicas())
+
+	// Replica 1 goes silent
+	m.members.lastSeen[1] = time.Now().Add(-2 * replicaFailureTimeout)
+	m.members.expire()
+	assert.Equal(t, []int{0}, m.liveReplicas())
+	assert.NotNil(t, m.checkReplicasAlive([]int{0, 1}))
+
+	// and comes back
+	var reply client.HeartbeatResult
+	assert.Nil(t, m.Heartbeat(&client.HeartbeatArgs{ReplicaNum: 1, Incarnation: "b"}, &reply))
+	assert.False(t, reply.Discard)
+	assert.Equal(t, []int{0, 1}, m.liveReplicas())
+	assert.Nil(t, m.checkReplicasAlive([]int{0, 1}))
+
+	assert.Len(t, m.members.events, 2)
+	assert.False(t, m.members.events[0].Alive)
+	assert.True(t, m.members.events[1].Alive)
+
+	// Strangers are turned away
+	assert.NotNil(t, m.Heartbeat(&client.HeartbeatArgs{ReplicaNum: 2}, &reply))
+}
@@ -0,0 +1,167 @@
+package master
+
+import (
+	"log"
+	"slices"
+	"twopc/pkg/client"
+	"twopc/pkg/common"
+	"twopc/pkg/lock"
+)
+
+// MasterOccAPI serves optimistic txs. They read through VersionedGet without
+// locking and send all their writes with CommitOptimistic, where each replica
+// votes no if anything the tx read has changed since.
+type MasterOccAPI interface {
+	VersionedGet(args *client.GetArgs, reply *client.VersionedGetResult) (err error)
+	CommitOptimistic(args *client.OptimisticCommitArgs, _ *int) (err error)
+}
+
+func (m *Master) VersionedGet(args *client.GetArgs, reply *client.VersionedGetResult) (err error) {
+	owner, err := m.lockReadAncestors(args.Key)
+	if err != nil {
+		log.Println("Master.VersionedGet unable to lock parents of key:", args.Key, err)
+		return
+	}
+	defer m.pathLocks.UnlockAll(owner)
+
+	rn, err := m.pickReplica(m.shardOf(args.Key))
+	if err != nil {
+		return
+	}
+	rc, err := m.replica(rn)
+	if err != nil {
+		return
+	}
+	var r *client.VersionedGetResult
+	err = m.read(rn, func() (err error) {
+		r, err = rc.VersionedGet(args.Key)
+		return
+	})
+	if err != nil {
+		log.Printf("Master.VersionedGet: request to replica %v for key %v failed\n", rn, args.Key)
+		return
+	}
+	*reply = *r
+	return nil
+}
+
+// CommitOptimistic runs the validation as the prepare phase of a regular
+// two-phase commit. A replica that missed a commit the tx read from has the
+// key either locked by that commit or at an older version, and votes no.
+func (m *Master) CommitOptimistic(args *client.OptimisticCommitArgs, _ *int) (err error) {
+	for {
+		err = m.commitOptimistic(args)
+		if err != movedError {
+			return
+		}
+		log.Println("Master.CommitOptimistic keys moved to another group, starting over")
+	}
+}
+
+func (m *Master) commitOptimistic(args *client.OptimisticCommitArgs) (err error) {
+	action := "CommitOptimistic"
+	groups := m.optimisticGroups(args)
+	err = m.checkReplicasAlive(m.replicasOf(groups))
+	if err != nil {
+		return
+	}
+	txId, err := m.begin(action, groups, nil)
+	if err != nil {
+		return
+	}
+	defer m.finish(txId)
+
+	if !slices.Equal(m.optimisticGroups(args), groups) {
+		// A rebalance started or cut over while we waited
+		m.abort(action, txId)
+		return movedError
+	}
+
+	err = m.lockOptimistic(txId, args)
+	if err != nil {
+		log.Println("Master."+action+" unable to lock keys in tx:", txId, err)
+		m.abort(action, txId)
+		return TxAbortedError
+	}
+
+	log.Println("Master."+action+" asking replicas to validate tx:", txId, "reads:", len(args.Reads), "writes:", len(args.Writes))
+	if !m.prepare(m.replicasOf(groups), action, txId, nil, func(r *client.ReplicaClient, txId string, i int, rd common.ReplicaDeath) (*bool, error) {
+		return prepareOptimistic(r, txId, m.optimisticShard(m.groupOf(i), args))
+	}) {
+		log.Println("Master."+action+" asking replicas to abort tx:", txId)
+		m.abort(action, txId)
+		return TxAbortedError
+	}
+
+	err = m.commit(txId)
+	if err != nil {
+		log.Println("Master."+action+" unable to commit, asking replicas to abort tx:", txId, err)
+		m.abort(action, txId)
+		return TxAbortedError
+	}
+
+	log.Println("Master."+action+" asking replicas to commit tx:", txId)
+	m.SendAndWaitForCommit(action, txId, nil)
+	return nil
+}
+
+func (m *Master) lockOptimistic(txId string, args *client.OptimisticCommitArgs) (err error) {
+	keys := make([]string, len(args.Writes))
+	for i, w := range args.Writes {
+		if err = m.lockAncestors(txId, w.Key, lock.IntentionExclusive); err != nil {
+			return
+		}
+		keys[i] = w.Key
+	}
+	for _, r := range args.Reads {
+		if err = m.lockAncestors(txId, r.Key, lock.IntentionShared); err != nil {
+			return
+		}
+	}
+	return m.admit(txId, keys...)
+}
+
+// optimisticGroups lists the groups a tx's writes go to and those owning
+// what it read, in ascending order.
+func (m *Master) optimisticGroups(args *client.OptimisticCommitArgs) []int {
+	groups := make(map[int]bool)
+	for _, w := range args.Writes {
+		for _, g := range m.writeGroupsOf(w.Key) {
+			groups[g] = true
+		}
+	}
+	for _, r := range args.Reads {
+		groups[m.shardOf(r.Key)] = true
+	}
+	return sortedInts(groups)
+}
+
+// optimisticShard keeps the reads of keys group g owns and the writes it gets.
+func (m *Master) optimisticShard(g int, args *client.OptimisticCommitArgs) *client.OptimisticCommitArgs {
+	shard := &client.OptimisticCommitArgs{Reads: m.readsIn(g, args.Reads)}
+	for _, w := range args.Writes {
+		if slices.Contains(m.writeGroupsOf(w.Key), g) {
+			shard.Writes = append(shard.Writes, w)
+		}
+	}
+	return shard
+}
+
+// prepareOptimistic hands one replica the writes of a tx, each carrying the
+// read set, or just the read set if there are no writes.
+func prepareOptimistic(r *client.ReplicaClient, txId string, args *client.OptimisticCommitArgs) (success *bool, err error) {
+	if len(args.Writes) == 0 {
+		return r.Validate(txId, args.Reads)
+	}
+	for _, w := range args.Writes {
+		if w.Del {
+			success, err = r.TryDelOptimistic(w.Key, txId, args.Reads)
+		} else {
+			success, err = r.TryPutOptimistic(w.Key, w.Value, txId, args.Reads)
+		}
+		if err != nil || !*success {
+			return
+		}
+	}
+	return
+}
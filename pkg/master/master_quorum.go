@@ -0,0 +1,318 @@
+package master
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"time"
+	"twopc/pkg/client"
+	"twopc/pkg/common"
+)
+
+// maxHints is how many missed writes are kept per replica. Beyond that the
+// oldest are dropped and the replica is marked stale.
+const maxHints = 10000
+
+// hintedFile lists the replicas that missed writes not handed to them yet.
+// Hints themselves are only kept in memory, so after a restart of the master
+// these replicas are marked stale.
+const hintedFile = "hinted.json"
+
+// hintReplayInterval is how often hints are replayed to replicas that are up.
+const hintReplayInterval = time.Second
+
+var (
+	QuorumError = errors.New("not enough replicas up for a write quorum")
+)
+
+// WriteQuorum is how many replicas of a group must vote yes for a Put or Del
+// to commit.
+type WriteQuorum int
+
+const (
+	// QuorumAll needs every replica, so one that is down fails every write.
+	QuorumAll WriteQuorum = iota
+	// QuorumMajority commits with a majority. The writes the others missed
+	// are kept as hints and replayed once they are back.
+	QuorumMajority
+)
+
+func (q WriteQuorum) String() string {
+	switch q {
+	case QuorumAll:
+		return "all"
+	case QuorumMajority:
+		return "majority"
+	default:
+		panic("unhandled default case")
+	}
+}
+
+func ParseWriteQuorum(s string) (WriteQuorum, error) {
+	switch s {
+	case "all":
+		return QuorumAll, nil
+	case "majority":
+		return QuorumMajority, nil
+	}
+	return QuorumAll, errors.New("unknown write quorum: " + s)
+}
+
+// votes sorts the replicas asked to prepare a tx by their answer. A replica
+// that didn't answer may still have prepared.
+type votes struct {
+	yes         []int
+	no          []int
+	unreachable []int
+}
+
+// size returns how many of n replicas must vote yes.
+func (q WriteQuorum) size(n int) int {
+	if q == QuorumMajority {
+		return n/2 + 1
+	}
+	return n
+}
+
+// accepts reports whether v is enough to commit a write to n replicas. A
+// replica voting no has a conflicting tx, so it vetoes under any quorum.
+func (q WriteQuorum) accepts(v votes, n int) bool {
+	return len(v.no) == 0 && len(v.yes) >= q.size(n)
+}
+
+// in keeps the votes of the replicas in nums.
+func (v votes) in(nums []int) (kept votes) {
+	for _, i := range nums {
+		switch {
+		case slices.Contains(v.yes, i):
+			kept.yes = append(kept.yes, i)
+		case slices.Contains(v.no, i):
+			kept.no = append(kept.no, i)
+		case slices.Contains(v.unreachable, i):
+			kept.unreachable = append(kept.unreachable, i)
+		}
+	}
+	return
+}
+
+// accepted reports whether v is enough to commit a write to each of groups.
+func (m *Master) accepted(v votes, groups []int) bool {
+	for _, g := range groups {
+		nums := m.groupReplicas(g)
+		if !m.writeQuorum.accepts(v.in(nums), len(nums)) {
+			return false
+		}
+	}
+	return true
+}
+
+// quorumReplicas splits the replicas of group into those a write is sent to
+// and those known to be down, which get hints instead. Under QuorumAll none
+// is left out.
+func (m *Master) quorumReplicas(group int) (live []int, down []int, err error) {
+	nums := m.groupReplicas(group)
+	if m.writeQuorum == QuorumAll {
+		return nums, nil, m.checkReplicasAlive(nums)
+	}
+
+	m.members.mu.Lock()
+	for _, i := range nums {
+		if alive, ok := m.members.alive[i]; ok && !alive {
+			down = append(down, i)
+		} else {
+			live = append(live, i)
+		}
+	}
+	m.members.mu.Unlock()
+	if len(live) < m.writeQuorum.size(len(nums)) {
+		return nil, nil, errors.New(fmt.Sprint(QuorumError, ": ", len(live), " of ", len(nums), " up in group ", group))
+	}
+	return
+}
+
+// vote sends one write of txId to the replicas in nums in parallel and
+// collects their votes.
+func (m *Master) vote(nums []int, action string, txId string, replicaDeaths []common.ReplicaDeath, f func(r *client.ReplicaClient, txId string, i int, rd common.ReplicaDeath) (*bool, error)) (v votes, err error) {
+	err = m.involve(txId, nums...)
+	if err != nil {
+		log.Println("Master."+action+" unable to involve replicas:", nums, "in tx:", txId, err)
+		return
+	}
+
+	var mu sync.Mutex
+	m.forReplicas(nums, func(i int, r *client.ReplicaClient) {
+		success, err := f(r, txId, i, getReplicaDeath(replicaDeaths, i))
+		if err != nil {
+			log.Println("Master."+action+" r.Try"+action+":", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case success == nil:
+			v.unreachable = append(v.unreachable, i)
+		case *success:
+			v.yes = append(v.yes, i)
+		default:
+			v.no = append(v.no, i)
+		}
+	})
+	return
+}
+
+// addHints keeps write for the replicas in nums, which missed it.
+func (m *Master) addHints(nums []int, write client.KeyVersion) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	changed := false
+	for _, i := range nums {
+		changed = changed || !m.hinted(i)
+		hints := append(m.hints[i], write)
+		if len(hints) > maxHints {
+			if !m.stale[i] {
+				log.Println("Master.addHints too many hints for replica", i, "dropping the oldest, it is stale until caught up")
+			}
+			hints = hints[len(hints)-maxHints:]
+			m.stale[i] = true
+		}
+		m.hints[i] = hints
+		log.Println("Master.addHints replica", i, "missed key:", write.Key, "at version:", write.CommitTs)
+	}
+	if changed {
+		m.saveHinted()
+	}
+}
+
+// hinted reports whether replica num missed writes it wasn't handed yet.
+func (m *Master) hinted(num int) bool {
+	return len(m.hints[num]) > 0 || m.stale[num]
+}
+
+// saveHinted writes the replicas that missed writes to hintedFile. A failure
+// is only logged: the replicas stay marked in memory, and anti-entropy repairs
+// them eventually after a restart too.
+func (m *Master) saveHinted() {
+	hinted := make(map[int]bool)
+	for i := range m.hints {
+		hinted[i] = true
+	}
+	for i := range m.stale {
+		hinted[i] = true
+	}
+	nums := sortedInts(hinted)
+	data, err := json.Marshal(nums)
+	if err == nil {
+		tmp := m.hintedPath + ".tmp"
+		err = os.WriteFile(tmp, data, 0644)
+		if err == nil {
+			err = os.Rename(tmp, m.hintedPath)
+		}
+	}
+	if err != nil {
+		log.Println("Master.saveHinted unable to save replicas with missed writes:", nums, err)
+	}
+}
+
+// loadHinted reads the replicas listed in hintedFile, whose hints were lost
+// with the master that kept them.
+func loadHinted(path string) (stale map[int]bool, err error) {
+	stale = make(map[int]bool)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return stale, nil
+	}
+	if err != nil {
+		return
+	}
+	var nums []int
+	err = json.Unmarshal(data, &nums)
+	if err != nil {
+		return nil, errors.New(fmt.Sprint("Unable to read ", path, ": ", err))
+	}
+	for _, i := range nums {
+		stale[i] = true
+	}
+	return
+}
+
+// pendingHints returns how many writes replica num still has to get.
+func (m *Master) pendingHints(num int) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.hints[num])
+}
+
+// isStale reports whether replica num lost some of the writes it missed.
+func (m *Master) isStale(num int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.stale[num]
+}
+
+func (m *Master) runHintedHandoff() {
+	for {
+		time.Sleep(hintReplayInterval)
+		for _, i := range m.liveReplicas() {
+			if m.pendingHints(i) > 0 {
+				m.replayHints(i)
+			}
+			if m.pendingHints(i) == 0 && m.isStale(i) {
+				m.catchUp(i)
+			}
+		}
+	}
+}
+
+// replayHints hands replica num the writes it missed, oldest first, until one
+// of them can't be applied yet, e.g. because the replica still has a tx on
+// the key prepared.
+func (m *Master) replayHints(num int) (replayed int) {
+	r, err := m.replica(num)
+	if err != nil {
+		return
+	}
+	m.mu.Lock()
+	hints := append([]client.KeyVersion(nil), m.hints[num]...)
+	m.mu.Unlock()
+
+	for _, h := range hints {
+		success, err := r.Repair(&h)
+		if err != nil {
+			break
+		}
+		if !*success {
+			// Either it has the version or a newer one already, or the key
+			// is busy
+			v, err := r.LatestVersion(h.Key)
+			if err != nil || !v.Found || common.TxOlder(v.CommitTs, h.CommitTs) {
+				break
+			}
+		}
+		replayed++
+	}
+
+	m.mu.Lock()
+	// New hints may have come in meanwhile. If old ones were dropped instead,
+	// the rest is replayed again next time, which does no harm.
+	pending := m.hints[num]
+	if replayed > 0 && len(pending) >= replayed && pending[0] == hints[0] {
+		m.hints[num] = pending[replayed:]
+	}
+	if len(m.hints[num]) == 0 {
+		delete(m.hints, num)
+		if !m.stale[num] {
+			m.saveHinted()
+		}
+	}
+	m.mu.Unlock()
+	if replayed > 0 {
+		log.Println("Master.replayHints replayed", replayed, "missed writes to replica", num)
+	}
+	return
+}
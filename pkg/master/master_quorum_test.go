@@ -0,0 +1,52 @@
+package master
+
+import (
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"twopc/pkg/client"
+)
+
+func TestMajorityAcceptsWithoutUnreachable(t *testing.T) {
+	assert.True(t, QuorumMajority.accepts(votes{yes: []int{0, 1}, unreachable: []int{2}}, 3))
+	assert.False(t, QuorumMajority.accepts(votes{yes: []int{0}, unreachable: []int{1, 2}}, 3))
+	assert.False(t, QuorumMajority.accepts(votes{yes: []int{0, 1}, no: []int{2}}, 3))
+	assert.False(t, QuorumMajority.accepts(votes{yes: []int{0}}, 2))
+	assert.True(t, QuorumMajority.accepts(votes{yes: []int{0}}, 1))
+}
+
+func TestAllNeedsEveryReplica(t *testing.T) {
+	assert.True(t, QuorumAll.accepts(votes{yes: []int{0, 1, 2}}, 3))
+	assert.False(t, QuorumAll.accepts(votes{yes: []int{0, 1}, unreachable: []int{2}}, 3))
+}
+
+func TestParseWriteQuorum(t *testing.T) {
+	for _, q := range []WriteQuorum{QuorumAll, QuorumMajority} {
+		parsed, err := ParseWriteQuorum(q.String())
+		assert.Nil(t, err)
+		assert.Equal(t, q, parsed)
+	}
+	_, err := ParseWriteQuorum("most")
+	assert.NotNil(t, err)
+}
+
+func TestDroppedHintsMarkReplicaStale(t *testing.T) {
+	m := &Master{
+		hints:      make(map[int][]client.KeyVersion),
+		stale:      make(map[int]bool),
+		hintedPath: filepath.Join(t.TempDir(), hintedFile),
+	}
+	m.addHints([]int{1, 2}, client.KeyVersion{Key: "a", CommitTs: "1"})
+	for i := 0; i < maxHints; i++ {
+		m.addHints([]int{2}, client.KeyVersion{Key: "b", CommitTs: strconv.Itoa(i + 2)})
+	}
+	assert.False(t, m.stale[1])
+	assert.True(t, m.stale[2])
+	assert.Equal(t, maxHints, len(m.hints[2]))
+
+	// A new master can't replay hints it never saw
+	stale, err := loadHinted(m.hintedPath)
+	assert.Nil(t, err)
+	assert.Equal(t, map[int]bool{1: true, 2: true}, stale)
+}
@@ -0,0 +1,418 @@
+package master
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"twopc/pkg/client"
+	"twopc/pkg/common"
+	"twopc/pkg/ring"
+)
+
+// shardsFile holds the key ranges Rebalance moved. From then on they
+// override the ring.
+const shardsFile = "shards.json"
+
+// ringFile holds the groups the ring was first built from. Other groups would
+// place keys elsewhere without moving their data, so the master won't start
+// with them.
+const ringFile = "ring.json"
+
+var (
+	InvalidRangeError = errors.New("key range is empty")
+	MigratingError    = errors.New("another key range is being moved")
+	CatchUpError      = errors.New("keys could not be copied to the new group")
+	RingChangedError  = errors.New("replica groups differ from those keys were placed on")
+	// movedError means the groups of a tx's keys changed while it waited
+	// to begin, so it has to start over.
+	movedError = errors.New("keys moved to another group")
+)
+
+// keyRange is the keys from Start up to, not including, End. An empty End
+// has no upper bound.
+type keyRange struct {
+	Start string `json:"start"`
+	End   string `json:"end,omitempty"`
+}
+
+func (r keyRange) contains(key string) bool {
+	return key >= r.Start && (r.End == "" || key < r.End)
+}
+
+func (r keyRange) String() string {
+	return fmt.Sprintf("[%q, %q)", r.Start, r.End)
+}
+
+// move hands a key range to a group, whoever owned its keys before.
+type move struct {
+	keyRange
+	Group int `json:"group"`
+}
+
+// placement maps keys to replica groups: by the ring, unless a move took
+// their range elsewhere.
+type placement struct {
+	mu   sync.Mutex
+	ring *ring.Ring
+	// moves apply in order, the later ones win. They only change while no
+	// tx is running, see Rebalance.
+	moves []move
+	// migrating is the move in progress, whose keys are written to both
+	// their owner and the new group. written collects the keys of its range
+	// writes went to since, which the cutover checks again.
+	migrating *move
+	written   map[string]bool
+	path      string
+}
+
+func newPlacement(r *ring.Ring, moves []move, path string) *placement {
+	return &placement{ring: r, moves: moves, path: path}
+}
+
+// owner returns the group holding key.
+func (p *placement) owner(key string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.locate(key)
+}
+
+// locate must be called with mu held.
+func (p *placement) locate(key string) int {
+	for i := len(p.moves) - 1; i >= 0; i-- {
+		if p.moves[i].contains(key) {
+			return p.moves[i].Group
+		}
+	}
+	return p.ring.Locate(key)
+}
+
+// writeGroups returns the groups a write of key goes to, in ascending order:
+// its owner and, while its range is being moved, the new group.
+func (p *placement) writeGroups(key string) []int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	groups := map[int]bool{p.locate(key): true}
+	if p.migrating != nil && p.migrating.contains(key) {
+		groups[p.migrating.Group] = true
+		p.written[key] = true
+	}
+	return sortedInts(groups)
+}
+
+// writtenKeys lists the keys written to the range being moved so far, some of
+// which may not have committed.
+func (p *placement) writtenKeys() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return sortedKeys(p.written)
+}
+
+// startMigration makes writes to the range of mv go to its group as well.
+func (p *placement) startMigration(mv move) (err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.migrating != nil {
+		return errors.New(fmt.Sprint(MigratingError, ": ", p.migrating.keyRange))
+	}
+	p.migrating = &mv
+	p.written = make(map[string]bool)
+	return nil
+}
+
+func (p *placement) cancelMigration() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.migrating = nil
+	p.written = nil
+}
+
+// cutover hands the range being moved to its new group for good.
+func (p *placement) cutover() (err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	moves := append(append([]move(nil), p.moves...), *p.migrating)
+	err = saveMoves(p.path, moves)
+	if err != nil {
+		return
+	}
+	p.moves = moves
+	p.migrating = nil
+	p.written = nil
+	return nil
+}
+
+// MasterRebalanceAPI moves key ranges between replica groups while txs go on.
+type MasterRebalanceAPI interface {
+	Rebalance(args *client.RebalanceArgs, reply *client.RebalanceResult) (err error)
+}
+
+// Rebalance moves the keys from args.Start up to args.End to group
+// args.Group. First every write to the range goes to the old and the new
+// group alike, through the same 2PC, while the committed versions are copied
+// over. Then, with txs held back, the keys written meanwhile and those that
+// couldn't be copied yet are checked again, and the range switches to the new
+// group at once. The old group keeps its copy but is no longer asked.
+func (m *Master) Rebalance(args *client.RebalanceArgs, reply *client.RebalanceResult) (err error) {
+	mv := move{keyRange{args.Start, args.End}, args.Group}
+	if mv.End != "" && mv.End <= mv.Start {
+		return errors.New(fmt.Sprint(InvalidRangeError, ": ", mv.keyRange))
+	}
+	if len(m.groupReplicas(mv.Group)) == 0 {
+		return errors.New(fmt.Sprint(NoGroupError, ": ", mv.Group))
+	}
+
+	// Every tx from now on writes the range to both groups
+	err = m.quiesce()
+	if err != nil {
+		log.Println("Master.Rebalance unable to move range:", mv.keyRange, err)
+		return
+	}
+	err = m.shards.startMigration(mv)
+	m.resume()
+	if err != nil {
+		return
+	}
+	log.Println("Master.Rebalance writing range:", mv.keyRange, "to group", mv.Group, "as well")
+
+	copied, behind, err := m.copyRange(mv, nil)
+	if err != nil {
+		log.Println("Master.Rebalance unable to copy range:", mv.keyRange, err)
+		m.shards.cancelMigration()
+		return
+	}
+	log.Println("Master.Rebalance copied", copied, "keys of range:", mv.keyRange, "to group", mv.Group, "with", len(behind), "left to catch up")
+
+	err = m.quiesce()
+	if err != nil {
+		log.Println("Master.Rebalance unable to cut over range:", mv.keyRange, err)
+		m.shards.cancelMigration()
+		return
+	}
+	defer m.resume()
+	// Whatever wasn't written since was copied by the first pass
+	recheck := make(map[string]bool)
+	for _, key := range append(behind, m.shards.writtenKeys()...) {
+		recheck[key] = true
+	}
+	caughtUp, behind, err := m.copyRange(mv, sortedKeys(recheck))
+	if err == nil && len(behind) > 0 {
+		err = errors.New(fmt.Sprint(CatchUpError, ": ", behind))
+	}
+	if err == nil {
+		err = m.shards.cutover()
+	}
+	if err != nil {
+		log.Println("Master.Rebalance unable to cut over range:", mv.keyRange, err)
+		m.shards.cancelMigration()
+		return
+	}
+
+	reply.Copied = copied + caughtUp
+	log.Println("Master.Rebalance range:", mv.keyRange, "now belongs to group", mv.Group, "after copying", reply.Copied, "keys")
+	return nil
+}
+
+// copyRange brings the live replicas of the group of mv up to date with the
+// keys of its range that other groups own, or only with keys unless that is
+// nil. It counts the copies it made and lists the keys it couldn't copy yet,
+// e.g. because a tx has them prepared. Each key is read from enough replicas
+// of its group to see every committed write, or the pass fails.
+func (m *Master) copyRange(mv move, keys []string) (copied int, behind []string, err error) {
+	targets := m.liveIn(m.groupReplicas(mv.Group))
+	if len(targets) == 0 {
+		return 0, nil, errors.New(fmt.Sprint(QuorumError, ": no replica up in group ", mv.Group))
+	}
+	have, answered := m.rangeDigests(targets, mv.keyRange, keys, func(string) bool { return true })
+	if len(answered) < len(targets) {
+		return 0, nil, errors.New(fmt.Sprint(CatchUpError, ": only replicas ", answered, " of ", targets, " answered in group ", mv.Group))
+	}
+
+	committed := m.committedTimestamps()
+	for _, g := range m.allGroups() {
+		if g == mv.Group {
+			continue
+		}
+		nums := m.groupReplicas(g)
+		// Any quorum write reached one of them
+		need := len(nums) - m.writeQuorum.size(len(nums)) + 1
+		live := m.liveIn(nums)
+		if len(live) < need {
+			return copied, behind, errors.New(fmt.Sprint(QuorumError, ": ", len(live), " of ", len(nums), " up in group ", g))
+		}
+		owned, answered := m.rangeDigests(live, mv.keyRange, keys, func(key string) bool { return m.shardOf(key) == g })
+		if len(answered) < need {
+			return copied, behind, errors.New(fmt.Sprint(QuorumError, ": ", len(answered), " of ", len(nums), " answered in group ", g))
+		}
+
+		for _, key := range sortedKeys(owned) {
+			source, ok := latest(owned[key], committed)
+			if !ok {
+				continue
+			}
+			want := owned[key][source]
+			var v *client.KeyVersion
+			caughtUp := true
+			for _, i := range targets {
+				d, has := have[key][i]
+				if has && !common.TxOlder(d.CommitTs, want.CommitTs) {
+					continue
+				}
+				if m.copyVersion(source, i, key, &v) {
+					copied++
+				} else {
+					caughtUp = false
+				}
+			}
+			if !caughtUp {
+				behind = append(behind, key)
+			}
+		}
+	}
+	return
+}
+
+// copyVersion repairs key on replica to to the latest version on replica
+// from, fetched into v the first time.
+func (m *Master) copyVersion(from int, to int, key string, v **client.KeyVersion) bool {
+	if *v == nil {
+		latest, err := m.latestVersion(from, key)
+		if err != nil {
+			return false
+		}
+		*v = latest
+	}
+	r, err := m.replica(to)
+	if err != nil {
+		return false
+	}
+	success, err := r.Repair(*v)
+	return err == nil && *success
+}
+
+// rangeDigests lists the keys of r that keep holds for, as each of replicas
+// nums has them, along with the replicas that answered. Unless keys is nil
+// only those are looked up, one by one; otherwise every key is listed.
+func (m *Master) rangeDigests(nums []int, r keyRange, keys []string, keep func(key string) bool) (digests map[string]map[int]client.KeyDigest, answered []int) {
+	digests = make(map[string]map[int]client.KeyDigest)
+	var mu sync.Mutex
+	m.forReplicas(nums, func(i int, rc *client.ReplicaClient) {
+		found, err := listDigests(rc, keys)
+		if err != nil {
+			log.Println("Master.rangeDigests unable to list keys of replica:", i, err)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		answered = append(answered, i)
+		for _, d := range found {
+			if !r.contains(d.Key) || !keep(d.Key) {
+				continue
+			}
+			if digests[d.Key] == nil {
+				digests[d.Key] = make(map[int]client.KeyDigest)
+			}
+			digests[d.Key][i] = d
+		}
+	})
+	slices.Sort(answered)
+	return
+}
+
+// listDigests returns the digests of keys that rc has a version of, or of
+// all its keys if keys is nil. Value hashes are left out of the former.
+func listDigests(rc *client.ReplicaClient, keys []string) (digests []client.KeyDigest, err error) {
+	if keys == nil {
+		return rc.MerkleBucket(-1)
+	}
+	for _, key := range keys {
+		v, err := rc.LatestVersion(key)
+		if err != nil {
+			return nil, err
+		}
+		if v.Found {
+			digests = append(digests, client.KeyDigest{Key: key, CommitTs: v.CommitTs, Deleted: v.Deleted})
+		}
+	}
+	return
+}
+
+// liveIn keeps the replicas of nums that are up. One the heartbeats didn't
+// reach yet counts as up, as for writes, see quorumReplicas; if it is down
+// after all it won't answer, and rangeDigests tells.
+func (m *Master) liveIn(nums []int) (live []int) {
+	m.members.mu.Lock()
+	defer m.members.mu.Unlock()
+
+	for _, i := range nums {
+		if alive, ok := m.members.alive[i]; !ok || alive {
+			live = append(live, i)
+		}
+	}
+	return
+}
+
+func saveMoves(path string, moves []move) (err error) {
+	data, err := json.MarshalIndent(moves, "", "  ")
+	if err != nil {
+		return
+	}
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadMoves reads the saved moves, or none if no range was ever moved.
+func loadMoves(path string) (moves []move, err error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &moves)
+	return
+}
+
+// checkRingGroups fails if groups, those the ring is built from, differ from
+// the ones saved at path. The first time round they are saved.
+func checkRingGroups(path string, groups []int) (err error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		data, err = json.Marshal(groups)
+		if err != nil {
+			return
+		}
+		tmp := path + ".tmp"
+		err = os.WriteFile(tmp, data, 0644)
+		if err != nil {
+			return
+		}
+		return os.Rename(tmp, path)
+	}
+	if err != nil {
+		return
+	}
+	var saved []int
+	err = json.Unmarshal(data, &saved)
+	if err != nil {
+		return
+	}
+	if !slices.Equal(saved, groups) {
+		return errors.New(fmt.Sprint(RingChangedError, ": ", saved, " now ", groups))
+	}
+	return nil
+}
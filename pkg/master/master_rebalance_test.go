@@ -0,0 +1,168 @@
+package master
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/rpc"
+	"path"
+	"testing"
+	"time"
+	"twopc/pkg/client"
+	"twopc/pkg/common"
+	"twopc/pkg/replica"
+	"twopc/pkg/ring"
+)
+
+func TestKeyRangeContains(t *testing.T) {
+	r := keyRange{Start: "b", End: "d"}
+	assert.False(t, r.contains("a"))
+	assert.True(t, r.contains("b"))
+	assert.True(t, r.contains("c9"))
+	assert.False(t, r.contains("d"))
+	assert.True(t, keyRange{Start: "b"}.contains("zzz"))
+}
+
+func TestLaterMovesWin(t *testing.T) {
+	p := newPlacement(ring.New([]int{0}), []move{
+		{keyRange{"a", "m"}, 1},
+		{keyRange{"f", "h"}, 2},
+	}, "")
+	assert.Equal(t, 0, p.owner("0"))
+	assert.Equal(t, 1, p.owner("b"))
+	assert.Equal(t, 2, p.owner("g"))
+	assert.Equal(t, 1, p.owner("k"))
+	assert.Equal(t, 0, p.owner("m"))
+}
+
+func TestMigrationWritesToBothGroups(t *testing.T) {
+	p := newPlacement(ring.New([]int{0}), nil, path.Join(t.TempDir(), shardsFile))
+	assert.Nil(t, p.startMigration(move{keyRange{"a", "c"}, 1}))
+	assert.NotNil(t, p.startMigration(move{keyRange{"x", ""}, 1}))
+	assert.Equal(t, []int{0, 1}, p.writeGroups("b"))
+	assert.Equal(t, []int{0}, p.writeGroups("c"))
+	assert.Equal(t, 0, p.owner("b"))
+	assert.Equal(t, []string{"b"}, p.writtenKeys())
+
+	assert.Nil(t, p.cutover())
+	assert.Equal(t, []int{1}, p.writeGroups("b"))
+	assert.Equal(t, 1, p.owner("b"))
+
+	moves, err := loadMoves(p.path)
+	assert.Nil(t, err)
+	assert.Equal(t, []move{{keyRange{"a", "c"}, 1}}, moves)
+}
+
+func TestCancelledMigrationKeepsOwner(t *testing.T) {
+	p := newPlacement(ring.New([]int{0}), nil, path.Join(t.TempDir(), shardsFile))
+	assert.Nil(t, p.startMigration(move{keyRange{"a", "c"}, 1}))
+	p.cancelMigration()
+	assert.Equal(t, []int{0}, p.writeGroups("b"))
+
+	moves, err := loadMoves(p.path)
+	assert.Nil(t, err)
+	assert.Empty(t, moves)
+}
+
+func TestVotesIn(t *testing.T) {
+	v := votes{yes: []int{0, 3}, no: []int{1}, unreachable: []int{4}}
+	assert.Equal(t, votes{yes: []int{3}, unreachable: []int{4}}, v.in([]int{3, 4, 5}))
+	assert.False(t, QuorumMajority.accepts(v.in([]int{3, 4, 5}), 3))
+	assert.True(t, QuorumMajority.accepts(v.in([]int{0, 3, 4}), 3))
+}
+
+func TestRingGroupsMustNotChange(t *testing.T) {
+	p := path.Join(t.TempDir(), ringFile)
+	assert.Nil(t, checkRingGroups(p, []int{0, 1}))
+	assert.Nil(t, checkRingGroups(p, []int{0, 1}))
+	assert.ErrorContains(t, checkRingGroups(p, []int{0, 1, 2}), RingChangedError.Error())
+	assert.ErrorContains(t, checkRingGroups(p, []int{0}), RingChangedError.Error())
+}
+
+// startCluster runs a replica per entry of groups, each in the group given,
+// and a master for them, all in this process.
+func startCluster(t *testing.T, groups []int) *Master {
+	dir := t.TempDir()
+	cluster := &common.ClusterConfig{Master: common.NodeConfig{LogDir: path.Join(dir, "master")}}
+	var listeners []net.Listener
+	for i, g := range groups {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Nil(t, err)
+		t.Cleanup(func() { _ = l.Close() })
+		listeners = append(listeners, l)
+		cluster.Replicas = append(cluster.Replicas, common.NodeConfig{
+			Id:        i,
+			Listen:    l.Addr().String(),
+			Advertise: l.Addr().String(),
+			DataDir:   path.Join(dir, fmt.Sprint("replica", i)),
+			LogDir:    path.Join(dir, fmt.Sprint("replica", i)),
+			Group:     g,
+		})
+	}
+	for i, l := range listeners {
+		r := replica.NewReplica(cluster, i, replica.Options{})
+		assert.Nil(t, r.Recover())
+		server := rpc.NewServer()
+		assert.Nil(t, server.Register(r))
+		go func(l net.Listener) { _ = http.Serve(l, server) }(l)
+	}
+
+	m := NewMaster(cluster, Options{})
+	assert.Nil(t, m.Recover())
+	return m
+}
+
+func TestRebalanceWithConcurrentWrites(t *testing.T) {
+	m := startCluster(t, []int{0, 1})
+	var keys []string
+	moved := 0
+	for i := 0; i < 40; i++ {
+		key := fmt.Sprintf("k%02d", i)
+		keys = append(keys, key)
+		if i >= 20 && m.shardOf(key) == 0 {
+			moved++
+		}
+		assert.Nil(t, m.Put(&client.PutArgs{Key: key, Value: "v"}, nil))
+	}
+	assert.Positive(t, moved)
+
+	// Keep writing half the keys while the range is copied and cut over. The
+	// other half has to be copied.
+	written := make(map[string]string)
+	stop := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			key, value := keys[i%20], fmt.Sprint("w", i)
+			if m.Put(&client.PutArgs{Key: key, Value: value}, nil) == nil {
+				written[key] = value
+			}
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	var reply client.RebalanceResult
+	err := m.Rebalance(&client.RebalanceArgs{Start: "k", End: "l", Group: 1}, &reply)
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	<-done
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, reply.Copied, moved)
+
+	for _, key := range keys {
+		assert.Equal(t, 1, m.shardOf(key))
+		want, ok := written[key]
+		if !ok {
+			want = "v"
+		}
+		var got client.GetResult
+		assert.Nil(t, m.Get(&client.GetArgs{Key: key}, &got))
+		assert.Equal(t, want, got.Value, key)
+	}
+}
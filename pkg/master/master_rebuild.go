@@ -0,0 +1,177 @@
+package master
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+	"twopc/pkg/client"
+)
+
+// incarnationsFile maps each participant to the copy of its data it is
+// expected to run with.
+const incarnationsFile = "incarnations.json"
+
+var (
+	NoRebuildSourceError = errors.New("no other replica of the group is up to rebuild from")
+)
+
+// RebuildReplica replaces participant args.ReplicaNum, typically one whose
+// data was lost, with the running, empty replica at args.Address. Without an
+// address the participant's current one is used.
+func (m *Master) RebuildReplica(args *client.RebuildReplicaArgs, _ *int) (err error) {
+	address := args.Address
+	if address == "" {
+		r, err := m.replica(args.ReplicaNum)
+		if err != nil {
+			return err
+		}
+		address = r.Host()
+	}
+	err = m.rebuild(args.ReplicaNum, address)
+	if err != nil {
+		log.Println("Master.RebuildReplica unable to rebuild replica:", args.ReplicaNum, err)
+	}
+	return
+}
+
+// rebuild copies the stores and log of a live peer in the same group to the
+// empty replica at address and makes it participant num. Like for
+// AddReplica, no tx runs meanwhile, so the copy misses nothing.
+func (m *Master) rebuild(num int, address string) (err error) {
+	err = m.quiesce()
+	if err != nil {
+		return
+	}
+	defer m.resume()
+
+	old, err := m.replica(num)
+	if err != nil {
+		return
+	}
+
+	var snapshot *client.SnapshotResult
+	source := -1
+	for _, i := range m.copySources(m.groupOf(num), num) {
+		r, err := m.replica(i)
+		if err != nil {
+			continue
+		}
+		snapshot, err = r.Snapshot()
+		if err == nil {
+			source = i
+			break
+		}
+	}
+	if source < 0 {
+		return NoRebuildSourceError
+	}
+
+	target := old
+	if old.Host() != address {
+		target = client.NewReplicaClient(address)
+	} else {
+		// The old connection went down with the old replica
+		target.Reconnect()
+	}
+	incarnation, err := target.Rebuild(snapshot)
+	if err != nil {
+		return
+	}
+
+	m.mu.Lock()
+	m.replicas[num] = target
+	if target != old {
+		err = m.saveParticipants()
+	}
+	if err == nil {
+		m.incarnations[num] = *incarnation
+		err = m.saveIncarnations()
+	} else {
+		m.replicas[num] = old
+	}
+	m.mu.Unlock()
+	if err != nil {
+		return
+	}
+
+	m.members.mu.Lock()
+	m.members.lastSeen[num] = time.Now()
+	m.members.setAlive(num, true)
+	m.members.mu.Unlock()
+
+	log.Println("Master.rebuild replica", num, "at", address, "rebuilt from replica", source, "at log position", snapshot.LogPosition)
+	return nil
+}
+
+// checkIncarnation tells whether a heartbeat comes from the current copy of a
+// participant. A copy that was replaced while away is told to discard its
+// data. An empty one at the participant's address, e.g. restarted after its
+// data directory was lost or after discarding its data, is rebuilt from a
+// peer.
+func (m *Master) checkIncarnation(args *client.HeartbeatArgs, reply *client.HeartbeatResult) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	num := args.ReplicaNum
+	expected := m.incarnations[num]
+	switch {
+	case expected == "":
+		m.incarnations[num] = args.Incarnation
+		err := m.saveIncarnations()
+		if err != nil {
+			log.Println("Master.Heartbeat unable to save incarnations:", err)
+		}
+		return true
+	case args.Incarnation == expected:
+		return true
+	case !args.Empty:
+		log.Println("Replica", num, "at", args.Address, "came back with data of replaced incarnation", args.Incarnation, "telling it to discard it")
+		reply.Discard = true
+	case args.Address == m.replicas[num].Host() && !m.rebuilding[num]:
+		log.Println("Replica", num, "at", args.Address, "came back empty, rebuilding it")
+		m.rebuilding[num] = true
+		go func() {
+			err := m.rebuild(num, args.Address)
+			if err != nil {
+				log.Println("Master.rebuild unable to rebuild replica:", num, err)
+			}
+			m.mu.Lock()
+			delete(m.rebuilding, num)
+			m.mu.Unlock()
+		}()
+	}
+	return false
+}
+
+// saveIncarnations must be called with mu held.
+func (m *Master) saveIncarnations() (err error) {
+	data, err := json.MarshalIndent(m.incarnations, "", "  ")
+	if err != nil {
+		return
+	}
+	tmp := m.incarnationsPath + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return
+	}
+	return os.Rename(tmp, m.incarnationsPath)
+}
+
+func loadIncarnations(path string) (incarnations map[int]string, err error) {
+	incarnations = make(map[int]string)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return incarnations, nil
+	}
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &incarnations)
+	if err != nil {
+		err = errors.New(fmt.Sprint("Unable to read ", path, ": ", err))
+	}
+	return
+}
@@ -0,0 +1,76 @@
+package master
+
+import (
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+	"twopc/pkg/client"
+)
+
+func TestCheckIncarnation(t *testing.T) {
+	m := &Master{
+		replicas:         []*client.ReplicaClient{client.NewReplicaClient("localhost:1")},
+		groups:           map[int]int{0: 0},
+		members:          newMembership([]int{0}),
+		incarnations:     make(map[int]string),
+		incarnationsPath: filepath.Join(t.TempDir(), incarnationsFile),
+		rebuilding:       make(map[int]bool),
+	}
+	m.reconfigured = sync.NewCond(&m.mu)
+	heartbeat := func(incarnation string, address string, empty bool) (current bool, discard bool) {
+		var reply client.HeartbeatResult
+		current = m.checkIncarnation(&client.HeartbeatArgs{ReplicaNum: 0, Incarnation: incarnation, Address: address, Empty: empty}, &reply)
+		return current, reply.Discard
+	}
+
+	// The first copy seen is taken to be the current one
+	current, discard := heartbeat("a", "localhost:1", false)
+	assert.True(t, current)
+	assert.False(t, discard)
+	assert.Equal(t, "a", m.incarnations[0])
+	current, _ = heartbeat("a", "localhost:1", false)
+	assert.True(t, current)
+
+	// A replaced copy with data has to drop it
+	current, discard = heartbeat("b", "localhost:1", false)
+	assert.False(t, current)
+	assert.True(t, discard)
+
+	// Empty elsewhere it is left alone, it is no longer the participant
+	current, discard = heartbeat("c", "localhost:2", true)
+	assert.False(t, current)
+	assert.False(t, discard)
+	assert.Empty(t, m.rebuilding)
+
+	// Empty at the participant's address it is rebuilt, which fails here
+	// for lack of a peer to copy
+	current, discard = heartbeat("c", "localhost:1", true)
+	assert.False(t, current)
+	assert.False(t, discard)
+	assert.Eventually(t, func() bool {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return len(m.rebuilding) == 0 && !m.reconfiguring
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "a", m.incarnations[0])
+}
+
+func TestHintedReplicaIsNoCopySource(t *testing.T) {
+	m := &Master{
+		groups:     map[int]int{0: 0, 1: 0, 2: 0, 3: 0, 4: 1},
+		members:    newMembership([]int{0, 1, 2, 3, 4}),
+		hints:      map[int][]client.KeyVersion{1: {{Key: "a", CommitTs: "1"}}},
+		stale:      map[int]bool{2: true},
+		rebuilding: map[int]bool{3: true},
+	}
+	assert.Equal(t, []int{0}, m.copySources(0, -1))
+	assert.Empty(t, m.copySources(0, 0))
+	assert.Equal(t, []int{4}, m.copySources(1, -1))
+
+	// With every up replica missing writes there is nothing to copy from
+	m.hints[0] = m.hints[1]
+	_, err := m.bootstrap(nil, 0)
+	assert.Equal(t, NoBootstrapSourceError, err)
+}
@@ -0,0 +1,290 @@
+package master
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+	"twopc/pkg/client"
+	"twopc/pkg/common"
+)
+
+// reconfigureTimeout is how long a membership change waits for running txs
+// to finish. New txs wait for the change meanwhile.
+const reconfigureTimeout = 10 * time.Second
+
+// participantsFile holds the participant set once AddReplica or
+// RemoveReplica changed it. From then on it overrides the cluster config.
+const participantsFile = "replicas.json"
+
+var (
+	NotParticipantError    = errors.New("replica is not a participant")
+	ParticipantError       = errors.New("replica is already a participant")
+	ReconfiguringError     = errors.New("another membership change is in progress")
+	LastReplicaError       = errors.New("cannot remove the last replica of a group")
+	NoBootstrapSourceError = errors.New("no replica of the group is up and free of prepared txs to bootstrap from")
+)
+
+// participant is a replica in the participant set. Since is the timestamp it
+// joined at, empty for the replicas the cluster started with.
+type participant struct {
+	Id      int    `json:"id"`
+	Address string `json:"address"`
+	Group   int    `json:"group"`
+	Since   string `json:"since,omitempty"`
+}
+
+// MasterReconfigAPI changes the participant set between txs: it waits until
+// no tx is running, holding new ones back, so every tx sees one set from
+// start to end.
+type MasterReconfigAPI interface {
+	AddReplica(args *client.AddReplicaArgs, _ *int) (err error)
+	RemoveReplica(args *client.RemoveReplicaArgs, _ *int) (err error)
+}
+
+// AddReplica makes a running, empty replica a participant of an existing
+// group. It first gets the committed data of a participant of that group, so
+// it votes with the same contents as the rest.
+func (m *Master) AddReplica(args *client.AddReplicaArgs, _ *int) (err error) {
+	if args.ReplicaNum < 0 {
+		return errors.New(fmt.Sprint("Invalid replica id: ", args.ReplicaNum))
+	}
+	if len(m.groupReplicas(args.Group)) == 0 {
+		return errors.New(fmt.Sprint(NoGroupError, ": ", args.Group))
+	}
+	err = m.quiesce()
+	if err != nil {
+		log.Println("Master.AddReplica unable to add replica:", args.ReplicaNum, err)
+		return
+	}
+	defer m.resume()
+
+	if _, err = m.replica(args.ReplicaNum); err == nil {
+		return errors.New(fmt.Sprint(ParticipantError, ": ", args.ReplicaNum))
+	}
+
+	r := client.NewReplicaClient(args.Address)
+	source, err := m.bootstrap(r, args.Group)
+	if err != nil {
+		log.Println("Master.AddReplica unable to bootstrap replica:", args.ReplicaNum, err)
+		return
+	}
+
+	m.mu.Lock()
+	m.replicas = growReplicas(m.replicas, args.ReplicaNum)
+	m.replicas[args.ReplicaNum] = r
+	m.groups[args.ReplicaNum] = args.Group
+	m.joined[args.ReplicaNum] = m.timestamp()
+	// Learned from its first heartbeat
+	delete(m.incarnations, args.ReplicaNum)
+	err = m.saveParticipants()
+	if err != nil {
+		m.replicas[args.ReplicaNum] = nil
+		delete(m.groups, args.ReplicaNum)
+		delete(m.joined, args.ReplicaNum)
+	}
+	m.mu.Unlock()
+	if err != nil {
+		log.Println("Master.AddReplica unable to save participants:", err)
+		return
+	}
+
+	m.members.mu.Lock()
+	m.members.add(args.ReplicaNum)
+	m.members.mu.Unlock()
+
+	log.Println("Master.AddReplica replica", args.ReplicaNum, "at", args.Address, "joined group", args.Group, "bootstrapped from replica", source)
+	return nil
+}
+
+// RemoveReplica stops sending txs to a participant. The replica itself keeps
+// running until it is shut down.
+func (m *Master) RemoveReplica(args *client.RemoveReplicaArgs, _ *int) (err error) {
+	err = m.quiesce()
+	if err != nil {
+		log.Println("Master.RemoveReplica unable to remove replica:", args.ReplicaNum, err)
+		return
+	}
+	defer m.resume()
+
+	if _, err = m.replica(args.ReplicaNum); err != nil {
+		return
+	}
+	group := m.groupOf(args.ReplicaNum)
+	if len(m.groupReplicas(group)) == 1 {
+		// Its keys would have nowhere to go
+		return errors.New(fmt.Sprint(LastReplicaError, ": ", group))
+	}
+
+	m.mu.Lock()
+	r := m.replicas[args.ReplicaNum]
+	since := m.joined[args.ReplicaNum]
+	m.replicas[args.ReplicaNum] = nil
+	delete(m.groups, args.ReplicaNum)
+	delete(m.joined, args.ReplicaNum)
+	delete(m.incarnations, args.ReplicaNum)
+	delete(m.hints, args.ReplicaNum)
+	if m.stale[args.ReplicaNum] {
+		delete(m.stale, args.ReplicaNum)
+		m.saveHinted()
+	}
+	err = m.saveParticipants()
+	if err != nil {
+		m.replicas[args.ReplicaNum] = r
+		m.groups[args.ReplicaNum] = group
+		m.joined[args.ReplicaNum] = since
+	}
+	m.mu.Unlock()
+	if err != nil {
+		log.Println("Master.RemoveReplica unable to save participants:", err)
+		return
+	}
+
+	m.members.mu.Lock()
+	m.members.remove(args.ReplicaNum)
+	m.members.mu.Unlock()
+
+	log.Println("Master.RemoveReplica replica", args.ReplicaNum, "left")
+	return nil
+}
+
+// quiesce holds new txs back and waits for the running ones to finish. On
+// success the caller must call resume.
+func (m *Master) quiesce() (err error) {
+	m.mu.Lock()
+	if m.reconfiguring {
+		m.mu.Unlock()
+		return ReconfiguringError
+	}
+	m.reconfiguring = true
+	m.mu.Unlock()
+
+	deadline := time.Now().Add(reconfigureTimeout)
+	for {
+		m.mu.Lock()
+		active := m.active
+		m.mu.Unlock()
+		if active == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			m.resume()
+			return errors.New(fmt.Sprint("Txs still running after ", reconfigureTimeout, ": ", active))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (m *Master) resume() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.reconfiguring = false
+	m.reconfigured.Broadcast()
+}
+
+// bootstrap copies the committed data of a live participant of group to r.
+// With no tx running, a participant without prepared txs has applied every
+// outcome. One that missed an outcome still has the tx prepared, and is
+// skipped, as are those missing writes, see copySources.
+func (m *Master) bootstrap(r *client.ReplicaClient, group int) (source int, err error) {
+	for _, i := range m.copySources(group, -1) {
+		rc, err := m.replica(i)
+		if err != nil {
+			continue
+		}
+		snapshot, err := rc.Snapshot()
+		if err != nil {
+			log.Println("Master.bootstrap unable to snapshot replica:", i, err)
+			continue
+		}
+		if len(snapshot.Temp) > 0 {
+			log.Println("Master.bootstrap replica", i, "has prepared txs, skipping it")
+			continue
+		}
+		return i, r.Bootstrap(snapshot)
+	}
+	return -1, NoBootstrapSourceError
+}
+
+// copySources lists the participants of group, but for except, that are up
+// and have every committed write, so a copy of their data can be handed to
+// another replica. One with hints or being rebuilt would pass on its gaps,
+// and nothing would fill them on the copy.
+func (m *Master) copySources(group int, except int) (nums []int) {
+	for _, i := range m.liveReplicas() {
+		if i != except && m.groupOf(i) == group && m.upToDate(i) {
+			nums = append(nums, i)
+		}
+	}
+	return
+}
+
+// participantsOf lists the replicas that may hold state of txId: those logged
+// with its start or, for a tx logged without them, the participants that were
+// there when it began. A replica added later never heard of it.
+func (m *Master) participantsOf(txId string) (nums []int) {
+	if nums, ok := m.involved(txId); ok {
+		return nums
+	}
+	for _, i := range m.allReplicas() {
+		m.mu.Lock()
+		since := m.joined[i]
+		m.mu.Unlock()
+		if since == "" || common.TxOlder(since, txId) {
+			nums = append(nums, i)
+		}
+	}
+	return
+}
+
+// saveParticipants writes the participant set. It must be called with mu
+// held.
+func (m *Master) saveParticipants() (err error) {
+	var participants []participant
+	for i, r := range m.replicas {
+		if r != nil {
+			participants = append(participants, participant{Id: i, Address: r.Host(), Group: m.groups[i], Since: m.joined[i]})
+		}
+	}
+	data, err := json.MarshalIndent(participants, "", "  ")
+	if err != nil {
+		return
+	}
+	tmp := m.participantsPath + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return
+	}
+	return os.Rename(tmp, m.participantsPath)
+}
+
+// loadParticipants reads the saved participant set, or takes the replicas of
+// the cluster config if it never changed.
+func loadParticipants(path string, cluster *common.ClusterConfig) (participants []participant, err error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		for _, node := range cluster.Replicas {
+			participants = append(participants, participant{Id: node.Id, Address: node.Advertise, Group: node.Group})
+		}
+		return participants, nil
+	}
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &participants)
+	if err == nil && len(participants) == 0 {
+		err = errors.New(fmt.Sprint("No replicas in ", path))
+	}
+	return
+}
+
+// growReplicas makes room for replica id num.
+func growReplicas(replicas []*client.ReplicaClient, num int) []*client.ReplicaClient {
+	for len(replicas) <= num {
+		replicas = append(replicas, nil)
+	}
+	return replicas
+}
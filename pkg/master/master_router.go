@@ -0,0 +1,244 @@
+package master
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/rpc"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// latencyWeight is how much the newest read counts in a replica's
+	// average latency and error rate.
+	latencyWeight = 0.2
+	// latencyExpiry is how long a latency estimate holds without new reads.
+	// A replica avoided for being slow gets tried again after that.
+	latencyExpiry = 10 * time.Second
+	// maxErrorRate is the error rate above which a replica is avoided for
+	// errorBackoff after its last failed read.
+	maxErrorRate = 0.3
+	errorBackoff = 5 * time.Second
+)
+
+// ReadPolicy is how the master picks the replica a read goes to, among the
+// healthy ones of the key's group.
+type ReadPolicy int
+
+const (
+	// LeastLoaded picks the replica with the shortest expected wait: its
+	// average latency times the reads it already has in flight, plus one.
+	LeastLoaded ReadPolicy = iota
+	// Nearest picks the replica with the lowest average latency.
+	Nearest
+	// Pinned picks the first of Options.PinnedReplicas in the group, and
+	// falls back to Nearest if none is healthy.
+	Pinned
+	// Random spreads reads evenly.
+	Random
+)
+
+func (p ReadPolicy) String() string {
+	switch p {
+	case LeastLoaded:
+		return "least-loaded"
+	case Nearest:
+		return "nearest"
+	case Pinned:
+		return "pinned"
+	case Random:
+		return "random"
+	default:
+		panic("unhandled default case")
+	}
+}
+
+func ParseReadPolicy(s string) (ReadPolicy, error) {
+	switch s {
+	case "least-loaded":
+		return LeastLoaded, nil
+	case "nearest":
+		return Nearest, nil
+	case "pinned":
+		return Pinned, nil
+	case "random":
+		return Random, nil
+	}
+	return LeastLoaded, errors.New("unknown read policy: " + s)
+}
+
+// readStats is what the router knows about reads from one replica.
+type readStats struct {
+	inFlight   int
+	latency    time.Duration
+	sampled    time.Time
+	errorRate  float64
+	lastFailed time.Time
+}
+
+// router picks replicas to read from and learns from how the reads went.
+type router struct {
+	mu     sync.Mutex
+	policy ReadPolicy
+	pinned []int
+	stats  map[int]*readStats
+}
+
+func newRouter(policy ReadPolicy, pinned []int) *router {
+	return &router{
+		policy: policy,
+		pinned: pinned,
+		stats:  make(map[int]*readStats),
+	}
+}
+
+// get must be called with mu held.
+func (rt *router) get(num int) *readStats {
+	s, ok := rt.stats[num]
+	if !ok {
+		s = &readStats{}
+		rt.stats[num] = s
+	}
+	return s
+}
+
+// failing reports whether reads from num failed too often lately.
+func (rt *router) failing(num int, now time.Time) bool {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	s := rt.get(num)
+	return s.errorRate > maxErrorRate && now.Sub(s.lastFailed) < errorBackoff
+}
+
+// pick chooses one of candidates, which must not be empty, by the policy.
+func (rt *router) pick(candidates []int, now time.Time) int {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	switch rt.policy {
+	case Random:
+		return candidates[rand.Intn(len(candidates))]
+	case Pinned:
+		for _, i := range rt.pinned {
+			if slices.Contains(candidates, i) {
+				return i
+			}
+		}
+	}
+
+	best, bestCost := -1, time.Duration(0)
+	for _, i := range candidates {
+		s := rt.get(i)
+		latency := s.latency
+		if now.Sub(s.sampled) > latencyExpiry {
+			// Unknown or stale, worth a try
+			latency = 0
+		}
+		cost := latency
+		if rt.policy == LeastLoaded {
+			cost = latency * time.Duration(s.inFlight+1)
+			if latency == 0 {
+				// Spread reads while nothing is known yet
+				cost = time.Duration(s.inFlight)
+			}
+		}
+		if best < 0 || cost < bestCost {
+			best, bestCost = i, cost
+		}
+	}
+	return best
+}
+
+// begin counts a read sent to num.
+func (rt *router) begin(num int) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	rt.get(num).inFlight++
+}
+
+// end records how a read from num went. A read failed if the replica didn't
+// answer.
+func (rt *router) end(num int, took time.Duration, failed bool, now time.Time) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	s := rt.get(num)
+	s.inFlight--
+	failure := 0.0
+	if failed {
+		failure = 1
+		s.lastFailed = now
+	} else if s.sampled.IsZero() || now.Sub(s.sampled) > latencyExpiry {
+		s.latency = took
+		s.sampled = now
+	} else {
+		s.latency = time.Duration(latencyWeight*float64(took) + (1-latencyWeight)*float64(s.latency))
+		s.sampled = now
+	}
+	s.errorRate = latencyWeight*failure + (1-latencyWeight)*s.errorRate
+}
+
+// snapshot returns the average latency and error rate of reads from num.
+func (rt *router) snapshot(num int) (latency time.Duration, errorRate float64) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	s := rt.get(num)
+	return s.latency, s.errorRate
+}
+
+// pickReplica chooses the replica of group g a read goes to. Replicas that
+// are down, being rebuilt, still missing writes or failing reads are left
+// out, unless that leaves none.
+func (m *Master) pickReplica(g int) (num int, err error) {
+	nums := m.groupReplicas(g)
+	if len(nums) == 0 {
+		return -1, errors.New(fmt.Sprint(NoGroupError, ": ", g))
+	}
+
+	now := time.Now()
+	var healthy []int
+	for _, i := range nums {
+		if m.readable(i) && !m.router.failing(i, now) {
+			healthy = append(healthy, i)
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = nums
+	}
+	return m.router.pick(healthy, now), nil
+}
+
+// readable reports whether replica num is up and has all committed writes.
+func (m *Master) readable(num int) bool {
+	m.members.mu.Lock()
+	alive := m.members.alive[num]
+	m.members.mu.Unlock()
+
+	return alive && m.upToDate(num)
+}
+
+// upToDate reports whether replica num has every committed write, as far as
+// the master knows: it isn't being rebuilt and missed no write.
+func (m *Master) upToDate(num int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return !m.rebuilding[num] && !m.hinted(num)
+}
+
+// read runs a read on replica num through f and tells the router how it
+// went. An error the replica itself returned, e.g. for a missing key, still
+// means it is healthy.
+func (m *Master) read(num int, f func() error) error {
+	m.router.begin(num)
+	start := time.Now()
+	err := f()
+	var answered rpc.ServerError
+	m.router.end(num, time.Since(start), err != nil && !errors.As(err, &answered), time.Now())
+	return err
+}
@@ -0,0 +1,65 @@
+package master
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestLeastLoadedSpreadsInFlightReads(t *testing.T) {
+	rt := newRouter(LeastLoaded, nil)
+	now := time.Now()
+	first := rt.pick([]int{0, 1}, now)
+	rt.begin(first)
+	second := rt.pick([]int{0, 1}, now)
+	assert.NotEqual(t, first, second)
+}
+
+func TestNearestPicksLowestLatency(t *testing.T) {
+	rt := newRouter(Nearest, nil)
+	now := time.Now()
+	for _, i := range []int{0, 1, 2} {
+		rt.begin(i)
+	}
+	rt.end(0, 30*time.Millisecond, false, now)
+	rt.end(1, 5*time.Millisecond, false, now)
+	rt.end(2, 20*time.Millisecond, false, now)
+	assert.Equal(t, 1, rt.pick([]int{0, 1, 2}, now))
+	assert.Equal(t, 2, rt.pick([]int{0, 2}, now))
+
+	// A stale estimate gets tried again
+	assert.Equal(t, 0, rt.pick([]int{0, 1}, now.Add(latencyExpiry+time.Second)))
+}
+
+func TestPinnedFallsBackWhenPinnedUnavailable(t *testing.T) {
+	rt := newRouter(Pinned, []int{2, 1})
+	now := time.Now()
+	assert.Equal(t, 2, rt.pick([]int{0, 1, 2}, now))
+	assert.Equal(t, 1, rt.pick([]int{0, 1}, now))
+	assert.Equal(t, 0, rt.pick([]int{0}, now))
+}
+
+func TestFailingReplicaBacksOff(t *testing.T) {
+	rt := newRouter(LeastLoaded, nil)
+	now := time.Now()
+	assert.False(t, rt.failing(0, now))
+	for i := 0; i < 3; i++ {
+		rt.begin(0)
+		rt.end(0, time.Millisecond, true, now)
+	}
+	assert.True(t, rt.failing(0, now))
+	assert.False(t, rt.failing(0, now.Add(errorBackoff+time.Second)))
+	latency, errorRate := rt.snapshot(0)
+	assert.Equal(t, time.Duration(0), latency)
+	assert.Greater(t, errorRate, maxErrorRate)
+}
+
+func TestParseReadPolicy(t *testing.T) {
+	for _, p := range []ReadPolicy{LeastLoaded, Nearest, Pinned, Random} {
+		parsed, err := ParseReadPolicy(p.String())
+		assert.Nil(t, err)
+		assert.Equal(t, p, parsed)
+	}
+	_, err := ParseReadPolicy("fastest")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,147 @@
+package master
+
+import (
+	"errors"
+	"slices"
+	"twopc/pkg/client"
+	"twopc/pkg/common"
+)
+
+var (
+	NoGroupError = errors.New("no such replica group")
+)
+
+// shardOf returns the replica group owning key.
+func (m *Master) shardOf(key string) int {
+	return m.shards.owner(key)
+}
+
+// writeGroupsOf returns the groups writes of keys go to, in ascending order.
+// While a range is being moved its keys go to two groups.
+func (m *Master) writeGroupsOf(keys ...string) []int {
+	groups := make(map[int]bool)
+	for _, key := range keys {
+		for _, g := range m.shards.writeGroups(key) {
+			groups[g] = true
+		}
+	}
+	return sortedInts(groups)
+}
+
+// groupOf returns the group of participant num.
+func (m *Master) groupOf(num int) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.groups[num]
+}
+
+// groupReplicas lists the participants holding the keys of group g.
+func (m *Master) groupReplicas(g int) []int {
+	return m.replicasOf([]int{g})
+}
+
+// replicasOf lists the participants of groups.
+func (m *Master) replicasOf(groups []int) []int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.replicasIn(groups)
+}
+
+// replicasIn is replicasOf for callers holding mu.
+func (m *Master) replicasIn(groups []int) (nums []int) {
+	for _, g := range groups {
+		for i, r := range m.replicas {
+			if r != nil && m.groups[i] == g {
+				nums = append(nums, i)
+			}
+		}
+	}
+	return
+}
+
+// involve records that txId holds state on replicas nums, so its outcome is
+// sent there. A grown participant set is logged first, for recovery to send
+// the outcome there too. It must be called before asking them anything in
+// the tx. The log is written without holding mu; the set grows in memory
+// before, so an outcome decided meanwhile reaches the new replicas as well.
+func (m *Master) involve(txId string, nums ...int) (err error) {
+	grown, err := m.grow(txId, nums)
+	if err != nil || grown == nil {
+		return
+	}
+	return m.log.WriteStart(txId, grown)
+}
+
+// grow adds nums to the replicas of txId and returns them all, or nil if none
+// was new.
+func (m *Master) grow(txId string, nums []int) (grown []int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	replicas, ok := m.txReplicas[txId]
+	if !ok || m.txs[txId] != common.Started {
+		// Whoever ended it told the replicas it knew of
+		return nil, TxAbortedError
+	}
+	added := false
+	for _, i := range nums {
+		if !replicas[i] {
+			replicas[i] = true
+			added = true
+		}
+	}
+	if !added {
+		return nil, nil
+	}
+	return sortedInts(replicas), nil
+}
+
+// involved lists the replicas txId holds state on, ok is false for a tx that
+// is neither running nor recovered with its participants.
+func (m *Master) involved(txId string) (nums []int, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	replicas, ok := m.txReplicas[txId]
+	return sortedInts(replicas), ok
+}
+
+// readsIn keeps the reads of keys group g owns. A replica can only vouch for
+// the keys it holds.
+func (m *Master) readsIn(g int, reads []client.ReadVersion) (owned []client.ReadVersion) {
+	for _, r := range reads {
+		if m.shardOf(r.Key) == g {
+			owned = append(owned, r)
+		}
+	}
+	return
+}
+
+// without returns nums but those in drop.
+func without(nums []int, drop []int) (kept []int) {
+	for _, i := range nums {
+		if !slices.Contains(drop, i) {
+			kept = append(kept, i)
+		}
+	}
+	return
+}
+
+// allGroups lists the groups of the participants, in ascending order.
+func (m *Master) allGroups() []int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return groupsIn(m.groups)
+}
+
+// groupsIn lists the groups of the participants, in ascending order.
+func groupsIn(groups map[int]int) []int {
+	seen := make(map[int]bool)
+	for _, g := range groups {
+		seen[g] = true
+	}
+	return sortedInts(seen)
+}
@@ -0,0 +1,314 @@
+package master
+
+import (
+	"errors"
+	"log"
+	"time"
+	"twopc/pkg/client"
+	"twopc/pkg/common"
+	"twopc/pkg/lock"
+)
+
+// sessionIdleTimeout is how long an interactive tx may go without a call
+// before it is aborted. A client that went away would otherwise keep its locks
+// and hold back reconfiguration for good.
+const sessionIdleTimeout = time.Minute
+
+var (
+	UnknownTxError = errors.New("unknown or finished transaction")
+)
+
+// MasterTxAPI runs interactive transactions. Under common.Locking, reads take
+// a shared lock on one replica of the key's group, writes an exclusive lock on
+// all of them, and every lock is held until CommitTx or AbortTx. Snapshot txs
+// read without locks as of their start, the tx id, and only lock what they
+// write.
+type MasterTxAPI interface {
+	Begin(args *client.BeginArgs, reply *client.BeginResult) (err error)
+	TxGet(args *client.TxGetArgs, reply *client.TxGetResult) (err error)
+	TxPut(args *client.TxPutArgs, _ *int) (err error)
+	TxDel(args *client.TxDelArgs, _ *int) (err error)
+	CommitTx(args *client.TxArgs, _ *int) (err error)
+	AbortTx(args *client.TxArgs, _ *int) (err error)
+	LockPath(args *client.LockPathArgs, _ *int) (err error)
+}
+
+// session is an interactive tx between Begin and CommitTx or AbortTx.
+type session struct {
+	isolation common.Isolation
+	// readReplicas maps every group the tx read from to the replica serving
+	// all its reads there, so that one holds its read locks in the group.
+	readReplicas map[int]int
+	// reads are checked at commit under common.SerializableSnapshot.
+	reads []client.ReadVersion
+	// lastUsed is when the client last called, see sessionIdleTimeout.
+	lastUsed time.Time
+}
+
+// snapshot returns the timestamp txId reads at, or "" if it locks instead.
+func (s *session) snapshot(txId string) string {
+	if s.isolation == common.Locking {
+		return ""
+	}
+	return txId
+}
+
+func (m *Master) Begin(args *client.BeginArgs, reply *client.BeginResult) (err error) {
+	// Groups join as the tx reads and writes their keys
+	txId, err := m.begin("Begin", nil, nil)
+	if err != nil {
+		return
+	}
+
+	m.mu.Lock()
+	m.sessions[txId] = &session{isolation: args.Isolation, readReplicas: make(map[int]int), lastUsed: time.Now()}
+	m.mu.Unlock()
+
+	reply.TxId = txId
+	return nil
+}
+
+func (m *Master) TxGet(args *client.TxGetArgs, reply *client.TxGetResult) (err error) {
+	s, err := m.getSession(args.TxId)
+	if err != nil {
+		return
+	}
+
+	if s.isolation == common.Locking {
+		err = m.lockAncestors(args.TxId, args.Key, lock.IntentionShared)
+		if err != nil {
+			log.Println("Master.TxGet unable to lock parents of key:", args.Key, "in tx:", args.TxId, err)
+			m.abortSession("TxGet", args.TxId)
+			return TxAbortedError
+		}
+	}
+
+	rn, err := m.readReplica(s, m.shardOf(args.Key))
+	if err == nil {
+		err = m.involve(args.TxId, rn)
+	}
+	var rc *client.ReplicaClient
+	if err == nil {
+		rc, err = m.replica(rn)
+	}
+	var r *client.TxGetResult
+	if err == nil {
+		err = m.read(rn, func() (err error) {
+			r, err = rc.TxGet(args.Key, args.TxId, s.snapshot(args.TxId))
+			return
+		})
+	}
+	if err != nil || !r.Success {
+		log.Println("Master.TxGet unable to read key:", args.Key, "in tx:", args.TxId, "aborting")
+		m.abortSession("TxGet", args.TxId)
+		return TxAbortedError
+	}
+	if s.isolation == common.SerializableSnapshot {
+		m.mu.Lock()
+		s.reads = append(s.reads, client.ReadVersion{Key: args.Key, Version: r.Version})
+		m.mu.Unlock()
+	}
+	*reply = *r
+	return nil
+}
+
+func (m *Master) TxPut(args *client.TxPutArgs, _ *int) (err error) {
+	return m.txMutate(common.PutOp, args.TxId, args.Key,
+		func(r *client.ReplicaClient, txId string, snapshot string) (*bool, error) {
+			if snapshot != "" {
+				return r.TryPutSnapshot(args.Key, args.Value, txId, snapshot)
+			}
+			return r.TryPut(args.Key, args.Value, txId, common.ReplicaDontDie)
+		})
+}
+
+func (m *Master) TxDel(args *client.TxDelArgs, _ *int) (err error) {
+	return m.txMutate(common.DelOp, args.TxId, args.Key,
+		func(r *client.ReplicaClient, txId string, snapshot string) (*bool, error) {
+			if snapshot != "" {
+				return r.TryDelSnapshot(args.Key, txId, snapshot)
+			}
+			return r.TryDel(args.Key, txId, common.ReplicaDontDie)
+		})
+}
+
+// txMutate prepares one write of an interactive tx on every replica of the
+// groups the key is written to. The replicas keep the write staged and the
+// key locked until the tx ends.
+func (m *Master) txMutate(operation common.Operation, txId string, key string, write func(r *client.ReplicaClient, txId string, snapshot string) (*bool, error)) (err error) {
+	action := "Tx" + operation.String()
+	s, err := m.getSession(txId)
+	if err != nil {
+		return
+	}
+	// A running tx holds back any rebalance, so these stay put until it ends
+	nums := m.replicasOf(m.writeGroupsOf(key))
+	err = m.checkReplicasAlive(nums)
+	if err != nil {
+		// The tx can still go on once the replica is back
+		return
+	}
+	f := func(r *client.ReplicaClient, txId string, i int, rd common.ReplicaDeath) (*bool, error) {
+		return write(r, txId, s.snapshot(txId))
+	}
+
+	err = m.lockAncestors(txId, key, lock.IntentionExclusive)
+	if err != nil {
+		log.Println("Master."+action+" unable to lock parents of key:", key, "in tx:", txId, err)
+		m.abortSession(action, txId)
+		return TxAbortedError
+	}
+
+	log.Println("Master."+action+" asking replicas to "+operation.String()+" tx:", txId, "key:", key)
+	if !m.prepare(nums, action, txId, nil, f) {
+		log.Println("Master."+action+" asking replicas to abort tx:", txId, "key:", key)
+		m.abortSession(action, txId)
+		return TxAbortedError
+	}
+	return nil
+}
+
+func (m *Master) CommitTx(args *client.TxArgs, _ *int) (err error) {
+	s, err := m.getSession(args.TxId)
+	if err != nil {
+		return
+	}
+
+	if len(s.reads) > 0 && !m.validateSession(args.TxId, s) {
+		log.Println("Master.CommitTx reads of tx:", args.TxId, "were overwritten, aborting")
+		m.abortSession("CommitTx", args.TxId)
+		return TxAbortedError
+	}
+
+	err = m.commit(args.TxId)
+	if err != nil {
+		log.Println("Master.CommitTx unable to commit, asking replicas to abort tx:", args.TxId, err)
+		m.abortSession("CommitTx", args.TxId)
+		return TxAbortedError
+	}
+
+	m.mu.Lock()
+	delete(m.sessions, args.TxId)
+	m.mu.Unlock()
+
+	log.Println("Master.CommitTx asking replicas to commit tx:", args.TxId)
+	m.forReplicas(m.participantsOf(args.TxId), func(i int, r *client.ReplicaClient) {
+		m.sendAndWaitForCommit("CommitTx", args.TxId, r, common.ReplicaDontDie)
+	})
+	m.finish(args.TxId)
+	return nil
+}
+
+// validateSession checks that no tx committed over what a serializable
+// snapshot tx read. Together with first-committer-wins on its writes that
+// leaves no read-write antidependency on a concurrent tx, so the tx can be
+// serialized at its commit. The read locks taken here keep it that way until
+// then. Each read is checked on the replica that served it.
+func (m *Master) validateSession(txId string, s *session) bool {
+	m.mu.Lock()
+	var nums []int
+	for _, i := range s.readReplicas {
+		nums = append(nums, i)
+	}
+	m.mu.Unlock()
+	return m.prepare(nums, "CommitTx", txId, nil,
+		func(r *client.ReplicaClient, txId string, i int, rd common.ReplicaDeath) (*bool, error) {
+			return r.Validate(txId, m.readsIn(m.groupOf(i), s.reads))
+		})
+}
+
+// readReplica returns the replica serving the reads of s in group g, picking
+// one on the first read there.
+func (m *Master) readReplica(s *session, g int) (num int, err error) {
+	m.mu.Lock()
+	num, ok := s.readReplicas[g]
+	m.mu.Unlock()
+	if ok {
+		return
+	}
+	num, err = m.pickReplica(g)
+	if err != nil {
+		return
+	}
+	m.mu.Lock()
+	s.readReplicas[g] = num
+	m.mu.Unlock()
+	return
+}
+
+func (m *Master) AbortTx(args *client.TxArgs, _ *int) (err error) {
+	_, err = m.getSession(args.TxId)
+	if err != nil {
+		return
+	}
+	m.abortSession("AbortTx", args.TxId)
+	return nil
+}
+
+// getSession returns the session of a tx that is still running.
+func (m *Master) getSession(txId string) (s *session, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[txId]
+	if !ok {
+		if m.txs[txId] == common.Aborted {
+			// Aborted behind the client's back, e.g. as a deadlock victim
+			return nil, TxAbortedError
+		}
+		return nil, UnknownTxError
+	}
+	s.lastUsed = time.Now()
+	return s, nil
+}
+
+// endSession forgets the session of txId and reports whether there was one.
+// Whoever ends it finishes the tx.
+func (m *Master) endSession(txId string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.sessions[txId]
+	delete(m.sessions, txId)
+	return ok
+}
+
+// abortSession aborts an interactive tx on the replicas it touched.
+func (m *Master) abortSession(action string, txId string) {
+	state, _ := m.decideAbort(action, txId)
+	if state != common.Aborted || !m.endSession(txId) {
+		return
+	}
+
+	m.forReplicas(m.participantsOf(txId), func(i int, r *client.ReplicaClient) {
+		_, err := r.Abort(txId)
+		if err != nil {
+			log.Println("Master."+action+" r.Abort:", err)
+		}
+	})
+	m.finish(txId)
+}
+
+// abortIdleSessions aborts the interactive txs whose clients stopped calling.
+func (m *Master) abortIdleSessions() {
+	for {
+		time.Sleep(sessionIdleTimeout / 4)
+
+		for _, txId := range m.idleSessions() {
+			log.Println("Master.abortIdleSessions tx:", txId, "idle for over", sessionIdleTimeout, "aborting")
+			m.abortSession("Idle", txId)
+		}
+	}
+}
+
+func (m *Master) idleSessions() (txIds []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for txId, s := range m.sessions {
+		if time.Since(s.lastUsed) > sessionIdleTimeout {
+			txIds = append(txIds, txId)
+		}
+	}
+	return
+}
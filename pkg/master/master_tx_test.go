@@ -0,0 +1,89 @@
+package master
+
+import (
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+	"time"
+	"twopc/pkg/common"
+	"twopc/pkg/io"
+	"twopc/pkg/lock"
+)
+
+func newSessionMaster(t *testing.T, txIds ...string) *Master {
+	m := &Master{
+		log:        io.NewLogger(filepath.Join(t.TempDir(), "master.txt")),
+		txs:        make(map[string]common.TxState),
+		txReplicas: make(map[string]map[int]bool),
+		sessions:   make(map[string]*session),
+		pathLocks:  lock.NewManager(),
+	}
+	for _, txId := range txIds {
+		m.txs[txId] = common.Started
+		m.sessions[txId] = &session{lastUsed: time.Now()}
+		m.active++
+	}
+	return m
+}
+
+func TestAbortedSessionIsNoLongerActive(t *testing.T) {
+	m := newSessionMaster(t, "1", "2")
+
+	// A deadlock victim gives its place back before its client shows up
+	m.abort("Deadlock", "1")
+	assert.Equal(t, 1, m.active)
+	_, err := m.getSession("1")
+	assert.Equal(t, TxAbortedError, err)
+	assert.Equal(t, 1, m.active)
+
+	m.abortSession("AbortTx", "2")
+	m.abortSession("AbortTx", "2")
+	assert.Equal(t, 0, m.active)
+	_, err = m.getSession("3")
+	assert.Equal(t, UnknownTxError, err)
+}
+
+func TestIdleSessions(t *testing.T) {
+	m := newSessionMaster(t, "1", "2")
+	m.sessions["1"].lastUsed = time.Now().Add(-2 * sessionIdleTimeout)
+	assert.Equal(t, []string{"1"}, m.idleSessions())
+
+	// Any call counts as use
+	_, err := m.getSession("1")
+	assert.Nil(t, err)
+	assert.Empty(t, m.idleSessions())
+}
+
+func TestInvolveLogsGrownParticipants(t *testing.T) {
+	m := newSessionMaster(t, "1")
+	m.txReplicas["1"] = map[int]bool{0: true}
+
+	assert.Nil(t, m.involve("1", 1))
+	assert.Nil(t, m.involve("1", 0, 1))
+	nums, ok := m.involved("1")
+	assert.True(t, ok)
+	assert.Equal(t, []int{0, 1}, nums)
+
+	data, err := m.log.ReadPrefix(m.log.Position())
+	assert.Nil(t, err)
+	assert.Equal(t, "1,STARTED,NOOP,0 1\n", string(data))
+
+	m.abort("Deadlock", "1")
+	assert.Equal(t, TxAbortedError, m.involve("1", 2))
+}
+
+func TestAbortLeavesCommittedTxAlone(t *testing.T) {
+	m := newSessionMaster(t, "1", "2")
+	m.txs["1"] = common.Committed
+
+	// A deadlock victim that committed after the graph was built
+	assert.False(t, m.abort("Deadlock", "1"))
+	assert.Equal(t, common.Committed, m.txs["1"])
+	_, err := m.getSession("1")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, m.active)
+
+	assert.True(t, m.abort("Deadlock", "2"))
+	assert.False(t, m.abort("Deadlock", "2"))
+	assert.Equal(t, 1, m.active)
+}
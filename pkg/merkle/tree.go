@@ -0,0 +1,87 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"sort"
+)
+
+// Buckets is the number of leaves. Keys are spread over them by hash, so two
+// trees that differ in a few keys differ in a few leaves.
+const Buckets = 256
+
+// Entry is a key and a digest of its contents. Two replicas agree on a key
+// when their digests are equal.
+type Entry struct {
+	Key    string
+	Digest []byte
+}
+
+// Tree is a complete binary hash tree stored as a heap: the children of node
+// i are 2i+1 and 2i+2, and the last Buckets nodes are the leaves.
+type Tree struct {
+	Nodes [][]byte
+}
+
+// Bucket returns the leaf key belongs to.
+func Bucket(key string) int {
+	sum := sha256.Sum256([]byte(key))
+	return int(sum[0])
+}
+
+// Build hashes entries into a tree. Their order doesn't matter.
+func Build(entries []Entry) *Tree {
+	buckets := make([][]Entry, Buckets)
+	for _, e := range entries {
+		b := Bucket(e.Key)
+		buckets[b] = append(buckets[b], e)
+	}
+
+	t := &Tree{Nodes: make([][]byte, 2*Buckets-1)}
+	for b, bucket := range buckets {
+		sort.Slice(bucket, func(i, j int) bool { return bucket[i].Key < bucket[j].Key })
+		h := sha256.New()
+		for _, e := range bucket {
+			h.Write([]byte(e.Key))
+			h.Write([]byte{0})
+			h.Write(e.Digest)
+			h.Write([]byte{0})
+		}
+		t.Nodes[leaf(b)] = h.Sum(nil)
+	}
+	for i := Buckets - 2; i >= 0; i-- {
+		h := sha256.New()
+		h.Write(t.Nodes[2*i+1])
+		h.Write(t.Nodes[2*i+2])
+		t.Nodes[i] = h.Sum(nil)
+	}
+	return t
+}
+
+// Root summarizes the whole tree.
+func (t *Tree) Root() []byte {
+	return t.Nodes[0]
+}
+
+// Diff returns the buckets whose contents differ between a and b, in order.
+// It only descends into subtrees whose hashes differ.
+func Diff(a *Tree, b *Tree) (buckets []int) {
+	var visit func(i int)
+	visit = func(i int) {
+		if bytes.Equal(a.Nodes[i], b.Nodes[i]) {
+			return
+		}
+		if i >= Buckets-1 {
+			buckets = append(buckets, i-(Buckets-1))
+			return
+		}
+		visit(2*i + 1)
+		visit(2*i + 2)
+	}
+	visit(0)
+	return
+}
+
+func leaf(bucket int) int {
+	return Buckets - 1 + bucket
+}
@@ -0,0 +1,35 @@
+package merkle
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDiffSameEntries(t *testing.T) {
+	a := Build([]Entry{{"a", []byte("1")}, {"b", []byte("2")}})
+	b := Build([]Entry{{"b", []byte("2")}, {"a", []byte("1")}})
+
+	assert.Equal(t, a.Root(), b.Root())
+	assert.Empty(t, Diff(a, b))
+}
+
+func TestDiffFindsChangedBuckets(t *testing.T) {
+	entries := []Entry{{"a", []byte("1")}, {"b", []byte("2")}, {"c", []byte("3")}}
+	a := Build(entries)
+	b := Build([]Entry{{"a", []byte("1")}, {"b", []byte("changed")}, {"c", []byte("3")}, {"d", []byte("4")}})
+
+	expected := []int{Bucket("b"), Bucket("d")}
+	if expected[0] > expected[1] {
+		expected[0], expected[1] = expected[1], expected[0]
+	}
+	if expected[0] == expected[1] {
+		expected = expected[:1]
+	}
+	assert.NotEqual(t, a.Root(), b.Root())
+	assert.Equal(t, expected, Diff(a, b))
+}
+
+func TestDiffEmptyTrees(t *testing.T) {
+	assert.Empty(t, Diff(Build(nil), Build(nil)))
+	assert.Equal(t, []int{Bucket("a")}, Diff(Build(nil), Build([]Entry{{"a", nil}})))
+}
@@ -8,6 +8,7 @@ import (
 	"time"
 	"twopc/pkg/client"
 	"twopc/pkg/common"
+	"twopc/pkg/lock"
 )
 
 type IReplica2PC interface {
@@ -21,6 +22,9 @@ type IReplica2PC interface {
 func (r *Replica) Commit(args *client.CommitArgs, reply *client.ReplicaActionResult) (err error) {
 	r.dieIf(args.Die, common.ReplicaDieBeforeProcessingCommit)
 
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	reply.Success = false
 
 	txId := args.TxId
@@ -32,15 +36,14 @@ func (r *Replica) Commit(args *client.CommitArgs, reply *client.ReplicaActionRes
 		return errors.New(fmt.Sprint("Received commit for unknown transaction:", txId))
 	}
 
-	_, keyLocked := r.lockedKeys[tx.Key]
-	if !keyLocked {
-		// Shouldn't happen, key is unlocked
-		log.Println("Received commit for transaction with unlocked key:", txId)
-	}
-
-	switch tx.State {
-	case common.Prepared:
-		err = r.commitTx(txId, tx.Op, tx.Key, args.Die)
+	switch {
+	case tx.State == common.Prepared:
+		r.checkLocked(tx, "commit")
+		err = r.commitTx(tx, args.CommitTs, args.Die)
+	case tx.State == common.Started && len(tx.Ops) == 0:
+		// Read only, nothing to apply but the read locks to release
+		r.locks.UnlockAll(txId)
+		delete(r.txs, txId)
 	default:
 		log.Println("Received commit for transaction in state ", tx.State.String())
 	}
@@ -52,6 +55,9 @@ func (r *Replica) Commit(args *client.CommitArgs, reply *client.ReplicaActionRes
 }
 
 func (r *Replica) Abort(args *client.AbortArgs, reply *client.ReplicaActionResult) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	reply.Success = false
 
 	txId := args.TxId
@@ -62,15 +68,16 @@ func (r *Replica) Abort(args *client.AbortArgs, reply *client.ReplicaActionResul
 		return errors.New(fmt.Sprint("Received abort for unknown transaction:", txId))
 	}
 
-	_, keyLocked := r.lockedKeys[tx.Key]
-	if !keyLocked {
-		// Shouldn't happen, key is unlocked
-		log.Println("Received abort for transaction with unlocked key:", txId)
-	}
-
 	switch tx.State {
 	case common.Prepared:
-		r.abortTx(txId, tx.Op, tx.Key)
+		r.checkLocked(tx, "abort")
+		r.abortTx(tx)
+	case common.Started:
+		// Still waiting for a key, stop it from ever preparing
+		tx.State = common.Aborted
+		r.locks.Cancel(txId)
+		r.locks.UnlockAll(txId)
+		r.logState(txId, common.Aborted)
 	default:
 		log.Println("Received abort for transaction in state ", tx.State.String())
 	}
@@ -79,35 +86,74 @@ func (r *Replica) Abort(args *client.AbortArgs, reply *client.ReplicaActionResul
 	return nil
 }
 
-func (r *Replica) tryMutate(key string, txId string, die common.ReplicaDeath, op common.Operation, f func() error, reply *client.ReplicaActionResult) (err error) {
+// tryMutate prepares one write of a tx. A tx may write several keys, each
+// call adds one to what the replica promised to commit.
+// An optimistic tx also passes what it read, which must still be current, and
+// a snapshot tx its start, after which nobody else may have committed key.
+func (r *Replica) tryMutate(key string, txId string, die common.ReplicaDeath, op common.Operation, f func() error, reads []client.ReadVersion, snapshot string, reply *client.ReplicaActionResult) (err error) {
 	r.dieIf(die, common.ReplicaDieBeforeProcessingMutateRequest)
+
 	reply.Success = false
 
-	r.txs[txId] = &common.Tx{Id: txId, Key: key, Op: op, State: common.Started}
+	if r.log.Degraded() {
+		// The log is unusable, so we can't promise to commit anything
+		log.Println("Received", op.String(), "in read-only mode for key:", key, "in tx:", txId, " Aborting")
+		return nil
+	}
 
-	if _, ok := r.lockedKeys[key]; ok {
-		// Key is currently being modified, Abort
-		log.Println("Received", op.String(), "for locked key:", key, "in tx:", txId, " Aborting")
-		r.txs[txId].State = common.Aborted
-		r.log.WriteState(txId, common.Aborted)
+	tx, ok := r.beginTx(txId)
+	if !ok {
+		log.Println("Received", op.String(), "for key:", key, "in finished tx:", txId, " Aborting")
 		return nil
 	}
 
-	r.lockedKeys[key] = true
+	// Wait for the key without holding r.mu, the holder needs it to finish.
+	err = r.locks.Lock(txId, key, lock.Exclusive, r.lockTimeout)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err != nil {
+		// Key is still being used by someone else, Abort
+		log.Println("Received", op.String(), "for locked key:", key, "in tx:", txId, ":", err, " Aborting")
+		r.failTx(tx)
+		return nil
+	}
+	if tx.State != common.Started && tx.State != common.Prepared {
+		// Aborted by the master while we were waiting
+		log.Println("Transaction", txId, "ended while waiting for key:", key)
+		r.locks.UnlockAll(txId)
+		return nil
+	}
+	if !r.validateReads(txId, reads) || !r.firstCommitter(txId, key, snapshot) {
+		r.failTx(tx)
+		return nil
+	}
 
 	if f != nil {
 		err = f()
 		if err != nil {
 			log.Println("Unable to", op.String(), "uncommited val for transaction:", txId, "key:", key, ", Aborting")
-			r.txs[txId].State = common.Aborted
-			r.log.WriteState(txId, common.Aborted)
-			delete(r.lockedKeys, key)
+			r.failTx(tx)
 			return
 		}
 	}
 
-	r.txs[txId].State = common.Prepared
-	r.log.WriteOp(txId, common.Prepared, op, key)
+	err = r.log.WriteOp(txId, common.Prepared, op, key)
+	if err != nil {
+		// Without a durable prepare record we can't vote yes
+		log.Println("Unable to log prepare for transaction:", txId, "key:", key, err, ", Aborting")
+		if op == common.PutOp {
+			_ = r.tempStore.Del(r.getTempStoreKey(txId, key))
+		}
+		r.failTx(tx)
+		return nil
+	}
+	if tx.SetOp(op, key) == common.PutOp && op == common.DelOp {
+		// The value this tx staged earlier is gone for good
+		_ = r.tempStore.Del(r.getTempStoreKey(txId, key))
+	}
+	tx.State = common.Prepared
 	reply.Success = true
 
 	r.dieIf(die, common.ReplicaDieAfterLoggingPrepared)
@@ -115,67 +161,163 @@ func (r *Replica) tryMutate(key string, txId string, die common.ReplicaDeath, op
 	return
 }
 
-func (r *Replica) abortTx(txId string, op common.Operation, key string) {
-	delete(r.lockedKeys, key)
+// beginTx returns txId, registering it if this is the first we hear of it.
+// It fails if the tx already finished.
+func (r *Replica) beginTx(txId string) (tx *common.Tx, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tx, ok = r.txs[txId]
+	if !ok {
+		tx = &common.Tx{Id: txId, State: common.Started}
+		r.txs[txId] = tx
+		return tx, true
+	}
+	return tx, tx.State == common.Started || tx.State == common.Prepared
+}
 
-	switch op {
-	case common.PutOp:
-		// We no longer need the temp stored value
-		err := r.tempStore.Del(r.getTempStoreKey(txId, key))
-		if err != nil {
-			fmt.Println("Unable to del val for uncommitted tx:", txId, "key:", key)
+// failTx handles a vote no. A tx without writes is aborted here and now; one
+// that already prepared some waits for the master's abort.
+func (r *Replica) failTx(tx *common.Tx) {
+	if tx.State != common.Started {
+		return
+	}
+	tx.State = common.Aborted
+	r.locks.UnlockAll(tx.Id)
+	r.logState(tx.Id, common.Aborted)
+}
+
+func (r *Replica) checkLocked(tx *common.Tx, action string) {
+	for _, o := range tx.Ops {
+		if !r.locks.Holds(tx.Id, o.Key) {
+			// Shouldn't happen, key is unlocked
+			log.Println("Received", action, "for transaction with unlocked key:", tx.Id, o.Key)
 		}
-	case common.DelOp:
-		//nothing to undo here
-	default:
-		panic("unhandled default case")
 	}
+}
 
-	r.log.WriteState(txId, common.Aborted)
-	delete(r.txs, txId)
+func (r *Replica) abortTx(tx *common.Tx) {
+	r.locks.UnlockAll(tx.Id)
+
+	for _, o := range tx.Ops {
+		switch o.Op {
+		case common.PutOp:
+			// We no longer need the temp stored value
+			err := r.tempStore.Del(r.getTempStoreKey(tx.Id, o.Key))
+			if err != nil {
+				fmt.Println("Unable to del val for uncommitted tx:", tx.Id, "key:", o.Key)
+			}
+		case common.DelOp:
+			//nothing to undo here
+		default:
+			panic("unhandled default case")
+		}
+	}
+
+	r.logState(tx.Id, common.Aborted)
+	delete(r.txs, tx.Id)
 }
 
-func (r *Replica) commitTx(txId string, op common.Operation, key string, die common.ReplicaDeath) (err error) {
+// commitTx applies the writes of tx as of commitTs. A master from before
+// commit timestamps doesn't send one, the tx id stands in for it then.
+func (r *Replica) commitTx(tx *common.Tx, commitTs string, die common.ReplicaDeath) (err error) {
+	txId := tx.Id
+	if commitTs == "" {
+		commitTs = txId
+	}
 
-	switch op {
-	case common.PutOp:
-		val, err := r.tempStore.Get(r.getTempStoreKey(txId, key))
-		if err != nil {
-			return errors.New(fmt.Sprint("Unable to find val for uncommitted tx:", txId, "key:", key))
+	for _, o := range tx.Ops {
+		// The history goes first, it keeps the value being replaced if
+		// there is no history yet.
+		var val string
+		if o.Op == common.PutOp {
+			val, err = r.tempStore.Get(r.getTempStoreKey(txId, o.Key))
+			if err != nil {
+				return errors.New(fmt.Sprint("Unable to find val for uncommitted tx:", txId, "key:", o.Key))
+			}
 		}
-		err = r.committedStore.Put(key, val)
+		err = r.putVersion(o.Key, version{CommitTs: commitTs, Value: []byte(val), Deleted: o.Op == common.DelOp})
 		if err != nil {
-			return errors.New(fmt.Sprint("Unable to put committed val for tx:", txId, "key:", key))
+			return errors.New(fmt.Sprint("Unable to put version for tx:", txId, "key:", o.Key, ": ", err))
 		}
-	case common.DelOp:
-		err = r.committedStore.Del(key)
-		if err != nil {
-			return errors.New(fmt.Sprint("Unable to commit del val for tx:", txId, "key:", key))
+
+		switch o.Op {
+		case common.PutOp:
+			err = r.committedStore.Put(o.Key, val)
+			if err != nil {
+				return errors.New(fmt.Sprint("Unable to put committed val for tx:", txId, "key:", o.Key))
+			}
+		case common.DelOp:
+			err = r.committedStore.Del(o.Key)
+			if err != nil {
+				return errors.New(fmt.Sprint("Unable to commit del val for tx:", txId, "key:", o.Key))
+			}
+		default:
+			panic("unhandled default case")
 		}
-	default:
-		panic("unhandled default case")
 	}
 
-	r.log.WriteState(txId, common.Committed)
+	err = r.log.WriteState(txId, common.Committed)
+	if err != nil {
+		// Keep the tx prepared so the master's retry can log it again
+		return errors.New(fmt.Sprint("Unable to log commit for tx:", txId, ": ", err))
+	}
 	delete(r.txs, txId)
 
 	// Delete the temp data only after committed, in case we crash after deleting, but before committing
-	if op == common.PutOp {
-		err = r.tempStore.Del(r.getTempStoreKey(txId, key))
+	for _, o := range tx.Ops {
+		if o.Op != common.PutOp {
+			continue
+		}
+		err = r.tempStore.Del(r.getTempStoreKey(txId, o.Key))
 		r.dieIf(die, common.ReplicaDieAfterDeletingFromTempStore)
 		if err != nil {
-			fmt.Println("Unable to del committed val for tx:", txId, "key:", key)
+			fmt.Println("Unable to del committed val for tx:", txId, "key:", o.Key)
 		}
 	}
 	r.dieIf(die, common.ReplicaDieAfterLoggingCommitted)
 
-	// release the lock on the key only after committing
-	delete(r.lockedKeys, key)
+	// release the locks only after committing
+	r.locks.UnlockAll(txId)
 
 	return nil
 }
 
+// Recover rebuilds the txs from the log and resolves those left prepared by
+// asking the master, without holding mu while it waits for the answers.
 func (r *Replica) Recover() (err error) {
+	prepared, err := r.replayLog()
+	if err != nil {
+		return
+	}
+
+	// Prepared transactions still hold their keys; ask the master how they ended.
+	for _, txId := range prepared {
+		state, commitTs, err := r.getStatus(txId)
+		if err != nil {
+			log.Println("Unable to resolve transaction during recovery:", txId, err)
+			continue
+		}
+		err = r.resolveRecovered(txId, state, commitTs)
+		if err != nil {
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.didSuicide {
+		err = r.log.WriteSpecial(common.FirstRestartAfterSuicideMarker)
+	}
+	return
+}
+
+// replayLog finds the last state of every tx in the log, locks the keys of
+// those left prepared and returns them.
+func (r *Replica) replayLog() (prepared []string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	entries, err := r.log.Read()
 	if err != nil {
 		return
@@ -192,71 +334,84 @@ func (r *Replica) Recover() (err error) {
 			continue
 		}
 
-		if entry.State == common.Prepared {
-			entry.State = r.getStatus(entry.TxId)
-			switch entry.State {
-			case common.Aborted:
-				log.Println("Aborting transaction during recovery: ", entry.TxId, entry.Key)
-				r.abortTx(entry.TxId, common.RecoveryOp, entry.Key)
-			case common.Committed:
-				log.Println("Committing transaction during recovery: ", entry.TxId, entry.Key)
-				_ = r.commitTx(entry.TxId, common.RecoveryOp, entry.Key, common.ReplicaDontDie)
-			default:
-				panic("unhandled default case")
-			}
+		tx, ok := r.txs[entry.TxId]
+		if !ok {
+			tx = &common.Tx{Id: entry.TxId}
+			r.txs[entry.TxId] = tx
 		}
-
-		switch entry.State {
-		case common.Started:
-		case common.Prepared:
-			// abort
-		case common.Committed:
-			r.txs[entry.TxId] = &common.Tx{entry.TxId, entry.Key, entry.Op, common.Committed}
-		case common.Aborted:
-			r.txs[entry.TxId] = &common.Tx{entry.TxId, entry.Key, entry.Op, common.Aborted}
-		default:
-			panic("unhandled default case")
+		tx.State = entry.State
+		if entry.Op != common.NoOp {
+			tx.SetOp(entry.Op, entry.Key)
 		}
 	}
 
-	err = r.cleanUpTempStore()
-	if err != nil {
-		return
-	}
-
-	if r.didSuicide {
-		r.log.WriteSpecial(common.FirstRestartAfterSuicideMarker)
+	for txId, tx := range r.txs {
+		if tx.State != common.Prepared {
+			continue
+		}
+		for _, o := range tx.Ops {
+			_ = r.locks.Lock(txId, o.Key, lock.Exclusive, 0)
+		}
+		prepared = append(prepared, txId)
 	}
+	err = r.cleanUpTempStore()
 	return
 }
 
-func (r *Replica) getStatus(txId string) common.TxState {
-	c := client.NewMasterClient(common.MasterPort)
-	i := 0
-	for {
-		i++
-		state, err := c.Status(txId)
-		if err != nil {
-			time.Sleep(100 * time.Millisecond)
-			continue
-		}
+// resolveRecovered applies the outcome of a tx left prepared in the log,
+// unless the master's commit or abort got to it first.
+func (r *Replica) resolveRecovered(txId string, state common.TxState, commitTs string) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-		if i > 3 {
-			log.Println("Master is down")
-			return common.NoState
+	tx, ok := r.txs[txId]
+	if !ok || tx.State != common.Prepared {
+		return nil
+	}
+	switch state {
+	case common.Committed:
+		log.Println("Committing transaction during recovery: ", txId)
+		return r.commitTx(tx, commitTs, common.ReplicaDontDie)
+	case common.Aborted, common.NoState:
+		log.Println("Aborting transaction during recovery: ", txId)
+		r.abortTx(tx)
+	default:
+		log.Println("Transaction is still in doubt after recovery: ", txId, state.String())
+	}
+	return nil
+}
+
+func (r *Replica) getStatus(txId string) (state common.TxState, commitTs string, err error) {
+	c := client.NewMasterClient(r.masterHost)
+	for i := 0; i < 3; i++ {
+		var s *client.StatusResult
+		s, err = c.Status(txId)
+		if err == nil {
+			return s.State, s.CommitTs, nil
 		}
-		return *state
+		time.Sleep(100 * time.Millisecond)
 	}
+	log.Println("Master is down")
+	return common.NoState, "", err
 }
 
 func (r *Replica) dieIf(actual common.ReplicaDeath, expected common.ReplicaDeath) {
 	if !r.didSuicide && actual == expected {
 		log.Println("Killing self as requested at", expected)
-		r.log.WriteSpecial(common.KilledSelfMarker)
+		_ = r.log.WriteSpecial(common.KilledSelfMarker)
 		os.Exit(1)
 	}
 }
 
+// logState records an abort. Losing it is safe: recovery either never sees a
+// prepare record for the tx or asks the master how it ended.
+func (r *Replica) logState(txId string, state common.TxState) {
+	err := r.log.WriteState(txId, state)
+	if err != nil {
+		log.Println("Unable to log", state.String(), "for tx:", txId, err)
+	}
+}
+
 func (r *Replica) cleanUpTempStore() (err error) {
 	keys, err := r.tempStore.List()
 	if err != nil {
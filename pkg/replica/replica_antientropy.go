@@ -0,0 +1,149 @@
+package replica
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io/fs"
+	"log"
+	"strconv"
+	"twopc/pkg/client"
+	"twopc/pkg/common"
+	"twopc/pkg/merkle"
+)
+
+// MerkleTree hashes the latest committed version of every key, so the master
+// can tell which keys replicas disagree on without reading them all.
+func (r *Replica) MerkleTree(args *client.MerkleTreeArgs, reply *client.MerkleTreeResult) (err error) {
+	digests, err := r.digests(-1)
+	if err != nil {
+		return
+	}
+	entries := make([]merkle.Entry, len(digests))
+	for i, d := range digests {
+		entries[i] = merkle.Entry{Key: d.Key, Digest: digestBytes(d)}
+	}
+	reply.Tree = *merkle.Build(entries)
+	return nil
+}
+
+// MerkleBucket lists the keys behind one leaf of the tree.
+func (r *Replica) MerkleBucket(args *client.MerkleBucketArgs, reply *client.MerkleBucketResult) (err error) {
+	reply.Keys, err = r.digests(args.Bucket)
+	return
+}
+
+func (r *Replica) LatestVersion(args *client.ReplicaKeyArgs, reply *client.KeyVersion) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	v, err := r.latestVersion(args.Key)
+	if err != nil || v == nil {
+		return
+	}
+	reply.Key = args.Key
+	reply.CommitTs = v.CommitTs
+	reply.Value = string(v.Value)
+	reply.Deleted = v.Deleted
+	reply.Found = true
+	return nil
+}
+
+// Repair installs a version this replica missed. It is refused while a tx
+// has the key prepared, since that tx's commit may be the very version, and
+// ignored unless it is newer than what we have.
+func (r *Replica) Repair(args *client.KeyVersion, reply *client.ReplicaActionResult) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	reply.Success = false
+	for _, tx := range r.txs {
+		undecided := tx.State == common.Started || tx.State == common.Prepared
+		if undecided && tx.GetOp(args.Key) != common.NoOp {
+			log.Println("Replica.Repair: key", args.Key, "is being written by tx:", tx.Id)
+			return nil
+		}
+	}
+	v, err := r.latestVersion(args.Key)
+	if err != nil {
+		return
+	}
+	if v != nil && !common.TxOlder(v.CommitTs, args.CommitTs) {
+		return nil
+	}
+
+	err = r.putVersion(args.Key, version{CommitTs: args.CommitTs, Value: []byte(args.Value), Deleted: args.Deleted})
+	if err != nil {
+		return
+	}
+	if args.Deleted {
+		err = r.committedStore.Del(args.Key)
+	} else {
+		err = r.committedStore.Put(args.Key, args.Value)
+	}
+	if err != nil {
+		return
+	}
+	r.hasData = true
+	log.Printf("Replica.Repair: key=%v, commitTs=%v, deleted=%v\n", args.Key, args.CommitTs, args.Deleted)
+	reply.Success = true
+	return nil
+}
+
+// digests sums up the keys in bucket, or all keys if bucket is negative.
+// Deleted keys stay in as long as their history does, so a delete spreads
+// like any other write.
+func (r *Replica) digests(bucket int) (digests []client.KeyDigest, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	committed, err := r.committedStore.List()
+	if err != nil {
+		return
+	}
+	versioned, err := r.versionStore.List()
+	if err != nil {
+		return
+	}
+	seen := make(map[string]bool)
+	for _, key := range append(committed, versioned...) {
+		if seen[key] || (bucket >= 0 && merkle.Bucket(key) != bucket) {
+			continue
+		}
+		seen[key] = true
+
+		v, err := r.latestVersion(key)
+		if err != nil {
+			return nil, err
+		}
+		if v == nil {
+			continue
+		}
+		sum := sha256.Sum256(v.Value)
+		digests = append(digests, client.KeyDigest{Key: key, CommitTs: v.CommitTs, Deleted: v.Deleted, ValueHash: sum[:]})
+	}
+	return
+}
+
+// latestVersion returns the newest committed version of key, or nil if it
+// was never written. It must be called with mu held.
+func (r *Replica) latestVersion(key string) (v *version, err error) {
+	h, err := r.getHistory(key)
+	if err != nil {
+		return
+	}
+	if n := len(h.Versions); n > 0 {
+		return &h.Versions[n-1], nil
+	}
+	val, err := r.committedStore.Get(key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return
+	}
+	return &version{Value: []byte(val)}, nil
+}
+
+func digestBytes(d client.KeyDigest) []byte {
+	return []byte(d.CommitTs + "\x00" + strconv.FormatBool(d.Deleted) + "\x00" + string(d.ValueHash))
+}
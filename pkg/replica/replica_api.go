@@ -1,14 +1,20 @@
 package replica
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
 	"net/http"
 	"net/rpc"
+	"path"
 	"strings"
+	"sync"
+	"time"
 	"twopc/pkg/client"
 	"twopc/pkg/common"
 	"twopc/pkg/io"
+	"twopc/pkg/lock"
 )
 
 type IReplicaAPI interface {
@@ -16,29 +22,87 @@ type IReplicaAPI interface {
 	TryPut(args *client.TxPutArgs, reply *client.ReplicaActionResult) (err error)
 	TryDel(args *client.TxDelArgs, reply *client.ReplicaActionResult) (err error)
 	Ping(args *client.ReplicaKeyArgs, reply *client.ReplicaGetResult) (err error)
+	Snapshot(args *client.SnapshotArgs, reply *client.SnapshotResult) (err error)
+	TxGet(args *client.TxGetArgs, reply *client.TxGetResult) (err error)
+	RenewLeases(args *client.RenewLeasesArgs, _ *int) (err error)
+	VersionedGet(args *client.ReplicaKeyArgs, reply *client.VersionedGetResult) (err error)
+	TryValidate(args *client.ValidateArgs, reply *client.ReplicaActionResult) (err error)
+	Locks(args *client.LocksArgs, reply *client.LocksResult) (err error)
+	Bootstrap(args *client.BootstrapArgs, _ *int) (err error)
+	MerkleTree(args *client.MerkleTreeArgs, reply *client.MerkleTreeResult) (err error)
+	MerkleBucket(args *client.MerkleBucketArgs, reply *client.MerkleBucketResult) (err error)
+	LatestVersion(args *client.ReplicaKeyArgs, reply *client.KeyVersion) (err error)
+	Repair(args *client.KeyVersion, reply *client.ReplicaActionResult) (err error)
+	Rebuild(args *client.SnapshotResult, reply *client.RebuildResult) (err error)
 }
 
 type Replica struct {
+	// mu serializes changes to the stores, the log and the tx table, so the
+	// stores frozen while holding it match the log.
+	mu sync.Mutex
+	// snapshotMu lets one snapshot at a time freeze the raw stores.
+	snapshotMu sync.Mutex
+
 	num            int
-	committedStore *io.KeyValueStore
-	tempStore      *io.KeyValueStore
+	node           common.NodeConfig
+	masterHost     string
+	committedStore io.IKeyValueStore
+	tempStore      io.IKeyValueStore
+	// versionStore maps a key to its history, see keyHistory.
+	versionStore   io.IKeyValueStore
+	raw            rawStores
 	txs            map[string]*common.Tx
-	lockedKeys     map[string]bool
-	log            *io.Logger
+	locks          lock.ILockManager
+	lockTimeout    time.Duration
+	deadlockPolicy lock.Policy
+	log            io.ILogger
 	didSuicide     bool
+	// incarnation names this copy of the data, so the master can tell a
+	// replica that was replaced while away from its replacement.
+	incarnation string
+	// hasData is set once data arrived other than through the log.
+	hasData bool
+
+	inDoubtAlert time.Duration
+	// inDoubt maps a tx whose lease ran out to when it did, until the tx is
+	// resolved.
+	inDoubt map[string]time.Time
+	// inDoubtAlerts counts the alerts raised so far.
+	inDoubtAlerts int
 }
 
-func NewReplica(num int) *Replica {
-	l := io.NewLogger(fmt.Sprintf("logs/replica%v.txt", num))
-	return &Replica{
+func NewReplica(cluster *common.ClusterConfig, num int, opts Options) *Replica {
+	node, err := cluster.Replica(num)
+	if err != nil {
+		log.Fatalln("newReplica:", err)
+	}
+	s := openStorage(node, opts)
+	r := &Replica{
 		num:            num,
-		committedStore: io.NewKeyValueStore(fmt.Sprintf("data/replica%v/committed", num)),
-		tempStore:      io.NewKeyValueStore(fmt.Sprintf("data/replica%v/temp", num)),
+		node:           node,
+		masterHost:     cluster.Master.Advertise,
+		committedStore: s.committedStore,
+		tempStore:      s.tempStore,
+		versionStore:   s.versionStore,
+		raw:            s.raw,
 		txs:            make(map[string]*common.Tx),
-		lockedKeys:     make(map[string]bool),
-		log:            l,
+		lockTimeout:    opts.LockTimeout,
+		deadlockPolicy: opts.DeadlockPolicy,
+		log:            s.log,
 		didSuicide:     false,
+		inDoubtAlert:   opts.InDoubtAlert,
+		inDoubt:        make(map[string]time.Time),
 	}
+	err = r.loadIncarnation()
+	if err != nil {
+		log.Fatalln("newReplica:", err)
+	}
+	r.locks = lock.NewManagerWithOptions(lock.Options{
+		Policy: opts.DeadlockPolicy,
+		Wound:  r.woundTx,
+		Lease:  opts.LeaseDuration,
+	})
+	return r
 }
 
 func (r *Replica) Get(args *client.ReplicaKeyArgs, reply *client.ReplicaGetResult) (err error) {
@@ -51,15 +115,69 @@ func (r *Replica) Get(args *client.ReplicaKeyArgs, reply *client.ReplicaGetResul
 	return
 }
 
+// TxGet reads key inside a tx and keeps a shared lock on it until the tx
+// commits or aborts. A tx sees its own writes.
+func (r *Replica) TxGet(args *client.TxGetArgs, reply *client.TxGetResult) (err error) {
+	log.Printf("Replica.TxGet: key=%v, txId=%v\n", args.Key, args.TxId)
+	reply.Success = false
+
+	tx, ok := r.beginTx(args.TxId)
+	if !ok {
+		log.Println("Received GET for key:", args.Key, "in finished tx:", args.TxId)
+		return nil
+	}
+	if args.Snapshot != "" {
+		return r.snapshotGet(tx, args.Key, args.Snapshot, reply)
+	}
+
+	// Wait for the key without holding r.mu, the holder needs it to finish.
+	err = r.locks.Lock(args.TxId, args.Key, lock.Shared, r.lockTimeout)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err != nil {
+		log.Println("Received GET for locked key:", args.Key, "in tx:", args.TxId, ":", err, " Aborting")
+		r.failTx(tx)
+		return nil
+	}
+	if tx.State != common.Started && tx.State != common.Prepared {
+		// Aborted by the master while we were waiting
+		r.locks.UnlockAll(args.TxId)
+		return nil
+	}
+
+	var val string
+	switch tx.GetOp(args.Key) {
+	case common.PutOp:
+		val, err = r.tempStore.Get(r.getTempStoreKey(args.TxId, args.Key))
+	case common.DelOp:
+		err = fs.ErrNotExist
+	default:
+		val, err = r.committedStore.Get(args.Key)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		reply.Success = true
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	reply.Value = val
+	reply.Found = true
+	reply.Success = true
+	return
+}
+
 func (r *Replica) TryPut(args *client.TxPutArgs, reply *client.ReplicaActionResult) (err error) {
 	writeToTempStore := func() error { return r.tempStore.Put(r.getTempStoreKey(args.TxId, args.Key), args.Value) }
 	log.Printf("Replica.TryPut: key=%v, value=%v, txId=%v, die=%v\n", args.Key, args.Value, args.TxId, args.Die)
-	return r.tryMutate(args.Key, args.TxId, args.Die, common.PutOp, writeToTempStore, reply)
+	return r.tryMutate(args.Key, args.TxId, args.Die, common.PutOp, writeToTempStore, args.Reads, args.Snapshot, reply)
 }
 
 func (r *Replica) TryDel(args *client.TxDelArgs, reply *client.ReplicaActionResult) (err error) {
 	log.Printf("Replica.TryDel: key=%v, txId=%v, die=%v\n", args.Key, args.TxId, args.Die)
-	return r.tryMutate(args.Key, args.TxId, args.Die, common.DelOp, nil, reply)
+	return r.tryMutate(args.Key, args.TxId, args.Die, common.DelOp, nil, args.Reads, args.Snapshot, reply)
 }
 
 func (r *Replica) Ping(args *client.ReplicaKeyArgs, reply *client.ReplicaGetResult) (err error) {
@@ -68,24 +186,112 @@ func (r *Replica) Ping(args *client.ReplicaKeyArgs, reply *client.ReplicaGetResu
 	return nil
 }
 
+// Snapshot captures the committed and temp stores together with the log up to
+// the matching position. Mutations wait only while the stores' file names are
+// listed; the values are copied after that, from what each key held then.
+// Values are returned as stored, so an encrypted replica yields an encrypted
+// snapshot.
+func (r *Replica) Snapshot(args *client.SnapshotArgs, reply *client.SnapshotResult) (err error) {
+	r.snapshotMu.Lock()
+	defer r.snapshotMu.Unlock()
+
+	r.mu.Lock()
+	err = r.raw.freeze()
+	reply.LogPosition = r.log.Position()
+	r.mu.Unlock()
+	if err != nil {
+		return
+	}
+	defer r.raw.thaw()
+
+	reply.Committed, err = r.raw.committed.ReadFrozen()
+	if err != nil {
+		return
+	}
+	reply.Temp, err = r.raw.temp.ReadFrozen()
+	if err != nil {
+		return
+	}
+	reply.Versions, err = r.raw.versions.ReadFrozen()
+	if err != nil {
+		return
+	}
+	reply.Log, err = r.log.ReadPrefix(reply.LogPosition)
+	if err != nil {
+		return
+	}
+	log.Printf("Replica.Snapshot: keys=%v, logPosition=%v\n", len(reply.Committed), reply.LogPosition)
+	return
+}
+
+// Locks lists the lock table along with the state of each tx in it.
+func (r *Replica) Locks(args *client.LocksArgs, reply *client.LocksResult) (err error) {
+	locks := r.locks.Locks()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, l := range locks {
+		info := client.LockInfo{
+			Replica: r.num,
+			TxId:    l.TxId,
+			Key:     l.Key,
+			Mode:    l.Mode.String(),
+			Waiting: l.Waiting,
+			Age:     time.Since(l.Since),
+		}
+		if tx, ok := r.txs[l.TxId]; ok {
+			info.State = tx.State
+		}
+		reply.Locks = append(reply.Locks, info)
+	}
+	return nil
+}
+
 func (r *Replica) getTempStoreKey(txId string, key string) string {
 	return txId + "__" + key
 }
 
 func (r *Replica) parseTempStoreKey(key string) (txId string, txKey string) {
-	split := strings.Split(key, "__")
+	split := strings.SplitN(key, "__", 2)
 	return split[0], split[1]
 }
 
-func RunReplica(num int) {
-	replica := NewReplica(num)
+func getLogPath(node common.NodeConfig) string {
+	return path.Join(node.LogDir, fmt.Sprintf("replica%v.txt", node.Id))
+}
+
+func getCommittedPath(node common.NodeConfig) string {
+	return path.Join(node.DataDir, "committed")
+}
+
+func getTempPath(node common.NodeConfig) string {
+	return path.Join(node.DataDir, "temp")
+}
+
+func getVersionsPath(node common.NodeConfig) string {
+	return path.Join(node.DataDir, "versions")
+}
+
+func getIncarnationPath(node common.NodeConfig) string {
+	return path.Join(node.DataDir, "incarnation")
+}
+
+func RunReplica(cluster *common.ClusterConfig, num int, opts Options) {
+	replica := NewReplica(cluster, num, opts)
 	err := replica.Recover()
 	if err != nil {
 		log.Fatal("Error during recovery: ", err)
 	}
 
+	if replica.deadlockPolicy == lock.WaitForLock {
+		go replica.reportWaitFor()
+	}
+	go replica.resolveExpiredLeases()
+	go replica.sendHeartbeats()
+
 	server := rpc.NewServer()
 	_ = server.Register(replica)
-	log.Println("Replica", num, "listening on port", common.ReplicaPortStart+num)
-	_ = http.ListenAndServe(client.GetReplicaHost(num), server)
+	log.Println("Replica", num, "listening on", replica.node.Listen)
+	_ = http.ListenAndServe(replica.node.Listen, server)
 }
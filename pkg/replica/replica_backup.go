@@ -0,0 +1,141 @@
+package replica
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"twopc/pkg/client"
+	"twopc/pkg/common"
+	"twopc/pkg/io"
+)
+
+// A backup directory holds the two stores, the log prefix and the position
+// that prefix ends at:
+//
+//	<dir>/committed/<key>
+//	<dir>/temp/<key>
+//	<dir>/versions/<key>
+//	<dir>/wal.txt
+//	<dir>/position
+const (
+	backupLogFile      = "wal.txt"
+	backupPositionFile = "position"
+)
+
+// WriteBackup stores a snapshot taken with Replica.Snapshot under dir.
+func WriteBackup(dir string, snapshot *client.SnapshotResult) (err error) {
+	entries, err := os.ReadDir(dir)
+	if err == nil && len(entries) > 0 {
+		return errors.New(fmt.Sprint("Backup directory is not empty:", dir))
+	}
+
+	err = writeAll(io.NewKeyValueStore(path.Join(dir, "committed")), snapshot.Committed)
+	if err != nil {
+		return
+	}
+	err = writeAll(io.NewKeyValueStore(path.Join(dir, "temp")), snapshot.Temp)
+	if err != nil {
+		return
+	}
+	err = writeAll(io.NewKeyValueStore(path.Join(dir, "versions")), snapshot.Versions)
+	if err != nil {
+		return
+	}
+	err = os.WriteFile(path.Join(dir, backupLogFile), snapshot.Log, 0644)
+	if err != nil {
+		return
+	}
+	return os.WriteFile(path.Join(dir, backupPositionFile), []byte(strconv.FormatInt(snapshot.LogPosition, 10)), 0644)
+}
+
+// RestoreBackup replaces the data and log of replica node with the backup in
+// dir. The replica must be stopped; on its next start Recover resolves any
+// transaction that was still prepared when the snapshot was taken.
+func RestoreBackup(dir string, node common.NodeConfig) (err error) {
+	snapshot, err := readBackup(dir)
+	if err != nil {
+		return
+	}
+
+	for _, p := range []string{getCommittedPath(node), getTempPath(node), getVersionsPath(node), getLogPath(node)} {
+		err = os.RemoveAll(p)
+		if err != nil {
+			return
+		}
+	}
+
+	err = writeAll(io.NewKeyValueStore(getCommittedPath(node)), snapshot.Committed)
+	if err != nil {
+		return
+	}
+	err = writeAll(io.NewKeyValueStore(getTempPath(node)), snapshot.Temp)
+	if err != nil {
+		return
+	}
+	err = writeAll(io.NewKeyValueStore(getVersionsPath(node)), snapshot.Versions)
+	if err != nil {
+		return
+	}
+	err = os.MkdirAll(path.Dir(getLogPath(node)), 0777)
+	if err != nil {
+		return
+	}
+	return os.WriteFile(getLogPath(node), snapshot.Log, 0644)
+}
+
+func readBackup(dir string) (snapshot *client.SnapshotResult, err error) {
+	snapshot = &client.SnapshotResult{}
+	position, err := os.ReadFile(path.Join(dir, backupPositionFile))
+	if err != nil {
+		return
+	}
+	snapshot.LogPosition, err = strconv.ParseInt(strings.TrimSpace(string(position)), 10, 64)
+	if err != nil {
+		return
+	}
+	snapshot.Log, err = os.ReadFile(path.Join(dir, backupLogFile))
+	if err != nil {
+		return
+	}
+	if int64(len(snapshot.Log)) != snapshot.LogPosition {
+		return nil, errors.New(fmt.Sprint("Backup log does not end at position ", snapshot.LogPosition, ": ", dir))
+	}
+	snapshot.Committed, err = readAll(io.NewKeyValueStore(path.Join(dir, "committed")))
+	if err != nil {
+		return
+	}
+	snapshot.Temp, err = readAll(io.NewKeyValueStore(path.Join(dir, "temp")))
+	if err != nil {
+		return
+	}
+	snapshot.Versions, err = readAll(io.NewKeyValueStore(path.Join(dir, "versions")))
+	return
+}
+
+func readAll(store io.IKeyValueStore) (values map[string]string, err error) {
+	keys, err := store.List()
+	if err != nil {
+		return
+	}
+	values = make(map[string]string, len(keys))
+	for _, key := range keys {
+		values[key], err = store.Get(key)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func writeAll(store io.IKeyValueStore, values map[string]string) (err error) {
+	for key, value := range values {
+		err = store.Put(key, value)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,36 @@
+package replica
+
+import (
+	"errors"
+	"log"
+	"twopc/pkg/client"
+)
+
+var (
+	NotEmptyError = errors.New("replica already has data, only an empty one can be bootstrapped")
+)
+
+// Bootstrap loads the committed data of another replica before this one joins
+// the participants. Values arrive as stored there, so both replicas must share
+// their encryption keys. Only a replica that never took part in a tx can be
+// bootstrapped, so there is nothing of its own to lose.
+func (r *Replica) Bootstrap(args *client.BootstrapArgs, _ *int) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.isEmpty() {
+		return NotEmptyError
+	}
+
+	err = writeAll(r.raw.committed, args.Committed)
+	if err != nil {
+		return
+	}
+	err = writeAll(r.raw.versions, args.Versions)
+	if err != nil {
+		return
+	}
+	r.hasData = true
+	log.Printf("Replica.Bootstrap: keys=%v\n", len(args.Committed))
+	return nil
+}
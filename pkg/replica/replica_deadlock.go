@@ -0,0 +1,41 @@
+package replica
+
+import (
+	"log"
+	"time"
+	"twopc/pkg/client"
+)
+
+const waitForReportInterval = 200 * time.Millisecond
+
+// reportWaitFor periodically sends the local wait-for edges to the master,
+// which looks for deadlocks spanning several replicas.
+func (r *Replica) reportWaitFor() {
+	c := client.NewMasterClient(r.masterHost)
+	reported := false
+	for {
+		time.Sleep(waitForReportInterval)
+
+		edges := r.locks.WaitForEdges()
+		if len(edges) == 0 && !reported {
+			continue
+		}
+		args := make([]client.WaitForEdge, len(edges))
+		for i, e := range edges {
+			args[i] = client.WaitForEdge{Waiter: e.Waiter, Holder: e.Holder, Key: e.Key}
+		}
+		// Keep reporting until an empty report clears our edges on the master.
+		reported = c.ReportWaitFor(r.num, args) != nil || len(edges) > 0
+	}
+}
+
+// woundTx asks the master to abort a younger tx standing in the way of an
+// older one. The master ignores it if the tx has already been decided, in
+// which case its locks are released soon anyway.
+func (r *Replica) woundTx(txId string) {
+	go func() {
+		log.Println("Wounding tx:", txId)
+		c := client.NewMasterClient(r.masterHost)
+		_ = c.Wound(txId)
+	}()
+}
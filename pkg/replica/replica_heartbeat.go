@@ -0,0 +1,33 @@
+package replica
+
+import (
+	"log"
+	"time"
+	"twopc/pkg/client"
+)
+
+const heartbeatInterval = 500 * time.Millisecond
+
+// sendHeartbeats tells the master we are up. Failures are silent: the master
+// being down is handled wherever we actually need it.
+func (r *Replica) sendHeartbeats() {
+	c := client.NewMasterClient(r.masterHost)
+	for {
+		r.mu.Lock()
+		incarnation, empty := r.incarnation, r.isEmpty()
+		r.mu.Unlock()
+
+		discard, err := c.Heartbeat(r.num, incarnation, r.node.Advertise, empty)
+		if err == nil && *discard {
+			log.Println("Replica", r.num, "was replaced while away, discarding its data")
+			err = r.discard()
+			if err == nil {
+				// Tell the master right away we are empty, so it
+				// rebuilds us from a peer
+				continue
+			}
+			log.Println("Unable to discard data:", err)
+		}
+		time.Sleep(heartbeatInterval)
+	}
+}
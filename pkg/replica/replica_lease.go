@@ -0,0 +1,93 @@
+package replica
+
+import (
+	"log"
+	"time"
+	"twopc/pkg/client"
+	"twopc/pkg/common"
+)
+
+const leaseCheckInterval = 500 * time.Millisecond
+
+// RenewLeases is called periodically by the master with the txs it hasn't
+// decided yet.
+func (r *Replica) RenewLeases(args *client.RenewLeasesArgs, _ *int) (err error) {
+	r.locks.Renew(args.TxIds)
+	return nil
+}
+
+// resolveExpiredLeases looks into every tx whose lease ran out. The master
+// stopped renewing it, so either it decided the tx and we missed the outcome,
+// or it is down.
+func (r *Replica) resolveExpiredLeases() {
+	for {
+		time.Sleep(leaseCheckInterval)
+		for _, txId := range r.locks.ExpiredLeases() {
+			r.resolveLease(txId)
+		}
+		r.checkInDoubt()
+	}
+}
+
+func (r *Replica) resolveLease(txId string) {
+	r.mu.Lock()
+	tx, ok := r.txs[txId]
+	var state common.TxState
+	if ok {
+		state = tx.State
+	}
+	r.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	decision, commitTs, err := r.getStatus(txId)
+	var reply client.ReplicaActionResult
+	switch {
+	case err == nil && decision == common.Committed:
+		log.Println("Lease expired, committing tx:", txId)
+		err = r.Commit(&client.CommitArgs{TxId: txId, CommitTs: commitTs}, &reply)
+		if err != nil {
+			log.Println("Unable to commit tx with expired lease:", txId, err)
+		}
+	case err == nil && (decision == common.Aborted || decision == common.NoState):
+		log.Println("Lease expired, aborting tx:", txId)
+		_ = r.Abort(&client.AbortArgs{TxId: txId}, &reply)
+	case err != nil && state == common.Started:
+		// We never voted yes, so the tx is ours to abort
+		log.Println("Lease expired and master unreachable, aborting tx:", txId)
+		_ = r.Abort(&client.AbortArgs{TxId: txId}, &reply)
+	default:
+		// Still undecided, or the master can't tell us. Try again once
+		// another lease has passed.
+		log.Println("Lease expired, tx is in doubt:", txId, decision.String(), err)
+		r.locks.Renew([]string{txId})
+		r.mu.Lock()
+		if _, ok := r.inDoubt[txId]; !ok {
+			r.inDoubt[txId] = time.Now()
+		}
+		r.mu.Unlock()
+	}
+}
+
+// checkInDoubt forgets resolved txs and raises an alert for those that have
+// been in doubt too long. A prepared tx can only wait for the master; until
+// it answers, the tx's keys stay locked.
+func (r *Replica) checkInDoubt() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for txId, since := range r.inDoubt {
+		tx, ok := r.txs[txId]
+		if !ok || (tx.State != common.Started && tx.State != common.Prepared) {
+			delete(r.inDoubt, txId)
+			continue
+		}
+		if r.inDoubtAlert > 0 && time.Since(since) > r.inDoubtAlert {
+			log.Println("ALERT: tx", txId, "has been in doubt for", time.Since(since).Round(time.Second), "holding keys:", tx.Ops)
+			r.inDoubtAlerts++
+			// Alert again only once another period has passed
+			r.inDoubt[txId] = time.Now()
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package replica
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+	"twopc/pkg/common"
+)
+
+func TestCheckInDoubtAlerts(t *testing.T) {
+	r := &Replica{
+		txs: map[string]*common.Tx{
+			"1": {Id: "1", State: common.Prepared},
+			"2": {Id: "2", State: common.Prepared},
+			"3": {Id: "3", State: common.Committed},
+		},
+		inDoubtAlert: time.Minute,
+		inDoubt: map[string]time.Time{
+			"1": time.Now().Add(-2 * time.Minute),
+			"2": time.Now(),
+			"3": time.Now().Add(-2 * time.Minute),
+		},
+	}
+
+	// Only the prepared tx in doubt for too long raises an alert, and the
+	// resolved one is forgotten
+	r.checkInDoubt()
+	assert.Equal(t, 1, r.inDoubtAlerts)
+	assert.Len(t, r.inDoubt, 2)
+	assert.NotContains(t, r.inDoubt, "3")
+
+	// The next alert waits for another period
+	r.checkInDoubt()
+	assert.Equal(t, 1, r.inDoubtAlerts)
+}
@@ -0,0 +1,227 @@
+package replica
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	"twopc/pkg/client"
+	"twopc/pkg/common"
+)
+
+// historyRetention is how long a replaced version is kept for snapshot txs
+// that might still read it. A tx older than that can fail to read.
+const historyRetention = time.Minute
+
+// preparedPollInterval is how often a snapshot read checks whether the
+// prepared writer of its key was resolved.
+const preparedPollInterval = 10 * time.Millisecond
+
+var (
+	SnapshotTooOldError = errors.New("versions needed by the snapshot were pruned")
+)
+
+// keyHistory holds the committed versions of a key, oldest first. A key that
+// existed before versions were kept starts with a version committed at "".
+type keyHistory struct {
+	Versions []version
+	// Pruned is set once versions were dropped from the front, so snapshots
+	// older than the first version left can no longer be served.
+	Pruned bool
+}
+
+type version struct {
+	CommitTs string
+	Value    []byte
+	Deleted  bool
+}
+
+func (r *Replica) getHistory(key string) (h keyHistory, err error) {
+	data, err := r.versionStore.Get(key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return keyHistory{}, nil
+	}
+	if err != nil {
+		return
+	}
+	if !strings.HasPrefix(data, "{") {
+		return r.legacyHistory(key, data)
+	}
+	err = json.Unmarshal([]byte(data), &h)
+	return
+}
+
+// legacyHistory reads a version written before histories were kept: the id of
+// the tx that last committed key. Tx ids come from the same clock as commit
+// timestamps and the tx committed after it started, so its id stands in for
+// the commit timestamp.
+func (r *Replica) legacyHistory(key string, txId string) (h keyHistory, err error) {
+	v := version{CommitTs: txId}
+	val, err := r.committedStore.Get(key)
+	switch {
+	case err == nil:
+		v.Value = []byte(val)
+	case errors.Is(err, fs.ErrNotExist):
+		v.Deleted = true
+	default:
+		return
+	}
+	return keyHistory{Versions: []version{v}}, nil
+}
+
+// putVersion adds v to the history of key. Committing the same tx twice, as
+// recovery may, adds it only once.
+func (r *Replica) putVersion(key string, v version) (err error) {
+	h, err := r.getHistory(key)
+	if err != nil {
+		return
+	}
+	if n := len(h.Versions); n > 0 && h.Versions[n-1].CommitTs == v.CommitTs {
+		return nil
+	}
+	if len(h.Versions) == 0 {
+		val, err := r.committedStore.Get(key)
+		if err == nil {
+			h.Versions = append(h.Versions, version{Value: []byte(val)})
+		}
+	}
+	h.Versions = append(h.Versions, v)
+	h.prune(strconv.FormatInt(time.Now().Add(-historyRetention).UnixNano(), 10))
+
+	data, err := json.Marshal(h)
+	if err != nil {
+		return
+	}
+	return r.versionStore.Put(key, string(data))
+}
+
+// prune drops the versions replaced before cutoff.
+func (h *keyHistory) prune(cutoff string) {
+	drop := 0
+	for drop+1 < len(h.Versions) && common.TxOlder(h.Versions[drop+1].CommitTs, cutoff) {
+		drop++
+	}
+	if drop > 0 {
+		h.Versions = h.Versions[drop:]
+		h.Pruned = true
+	}
+}
+
+// visible returns the version a snapshot taken at ts sees, or nil if the key
+// didn't exist then.
+func (h *keyHistory) visible(ts string) (v *version, err error) {
+	for i := len(h.Versions) - 1; i >= 0; i-- {
+		if !common.TxOlder(ts, h.Versions[i].CommitTs) {
+			return &h.Versions[i], nil
+		}
+	}
+	if h.Pruned {
+		return nil, SnapshotTooOldError
+	}
+	return nil, nil
+}
+
+// getVersion returns the commit timestamp of the latest version of key, or ""
+// if none was committed since versions were kept.
+func (r *Replica) getVersion(key string) (commitTs string, err error) {
+	h, err := r.getHistory(key)
+	if err != nil || len(h.Versions) == 0 {
+		return
+	}
+	return h.Versions[len(h.Versions)-1].CommitTs, nil
+}
+
+// snapshotGet reads key as of snapshot without locking. The tx still sees its
+// own writes. A tx that prepared a write of key may have been given a commit
+// timestamp below the snapshot already, so the read waits until it is
+// resolved, and fails once the lock timeout passed. The master then aborts the
+// tx, which can be retried.
+func (r *Replica) snapshotGet(tx *common.Tx, key string, snapshot string, reply *client.TxGetResult) (err error) {
+	deadline := time.Now().Add(r.lockTimeout)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for r.preparedWriter(tx.Id, key) {
+		if !time.Now().Before(deadline) {
+			log.Println("Unable to read key:", key, "in tx:", tx.Id, "at:", snapshot, "waiting for a prepared writer")
+			return nil
+		}
+		r.mu.Unlock()
+		time.Sleep(preparedPollInterval)
+		r.mu.Lock()
+	}
+	if tx.State != common.Started && tx.State != common.Prepared {
+		return nil
+	}
+
+	h, err := r.getHistory(key)
+	if err != nil {
+		return
+	}
+	var v *version
+	if len(h.Versions) == 0 {
+		// Never written since versions were kept, the committed value is
+		// as old as it gets
+		val, err := r.committedStore.Get(key)
+		if err == nil {
+			v = &version{Value: []byte(val)}
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	} else {
+		v, err = h.visible(snapshot)
+		if err != nil {
+			log.Println("Unable to read key:", key, "in tx:", tx.Id, "at:", snapshot, err)
+			return nil
+		}
+	}
+	if v != nil {
+		reply.Version = v.CommitTs
+		reply.Value = string(v.Value)
+		reply.Found = !v.Deleted
+	}
+
+	switch tx.GetOp(key) {
+	case common.PutOp:
+		reply.Value, err = r.tempStore.Get(r.getTempStoreKey(tx.Id, key))
+		if err != nil {
+			return
+		}
+		reply.Found = true
+	case common.DelOp:
+		reply.Value = ""
+		reply.Found = false
+	}
+	reply.Success = true
+	return nil
+}
+
+// preparedWriter reports whether a tx other than txId prepared a write of key.
+// It must be called with mu held.
+func (r *Replica) preparedWriter(txId string, key string) bool {
+	for id, tx := range r.txs {
+		if id != txId && tx.State == common.Prepared && tx.GetOp(key) != common.NoOp {
+			return true
+		}
+	}
+	return false
+}
+
+// firstCommitter reports whether a snapshot tx may write key: nobody else may
+// have committed it after the tx started. Concurrent writers that haven't
+// committed yet are kept out by the write lock. Always true outside a
+// snapshot tx.
+func (r *Replica) firstCommitter(txId string, key string, snapshot string) bool {
+	if snapshot == "" {
+		return true
+	}
+	latest, err := r.getVersion(key)
+	if err != nil || common.TxOlder(snapshot, latest) {
+		log.Println("Write conflict for tx:", txId, "key:", key, "committed at:", latest, "after:", snapshot, err)
+		return false
+	}
+	return true
+}
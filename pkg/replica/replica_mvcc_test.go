@@ -0,0 +1,107 @@
+package replica
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+	"twopc/pkg/client"
+	"twopc/pkg/common"
+	"twopc/pkg/io"
+)
+
+func TestKeyHistoryVisible(t *testing.T) {
+	h := keyHistory{Versions: []version{
+		{CommitTs: "", Value: []byte("legacy")},
+		{CommitTs: "20", Value: []byte("a")},
+		{CommitTs: "30", Deleted: true},
+	}}
+
+	v, err := h.visible("10")
+	assert.Nil(t, err)
+	assert.Equal(t, "legacy", string(v.Value))
+
+	v, err = h.visible("25")
+	assert.Nil(t, err)
+	assert.Equal(t, "a", string(v.Value))
+
+	v, err = h.visible("100")
+	assert.Nil(t, err)
+	assert.True(t, v.Deleted)
+}
+
+func TestKeyHistoryPrune(t *testing.T) {
+	h := keyHistory{Versions: []version{
+		{CommitTs: "10"},
+		{CommitTs: "20"},
+		{CommitTs: "40"},
+	}}
+
+	// The version replaced at 20 goes, the one replaced at 40 may still be
+	// read by snapshots from before the cutoff.
+	h.prune("30")
+	assert.True(t, h.Pruned)
+	assert.Equal(t, []version{{CommitTs: "20"}, {CommitTs: "40"}}, h.Versions)
+
+	_, err := h.visible("15")
+	assert.Equal(t, SnapshotTooOldError, err)
+	v, err := h.visible("25")
+	assert.Nil(t, err)
+	assert.Equal(t, "20", v.CommitTs)
+}
+
+func newStoreReplica(t *testing.T) *Replica {
+	return &Replica{
+		txs:            make(map[string]*common.Tx),
+		committedStore: io.NewKeyValueStore(t.TempDir()),
+		tempStore:      io.NewKeyValueStore(t.TempDir()),
+		versionStore:   io.NewKeyValueStore(t.TempDir()),
+	}
+}
+
+func TestLegacyVersionIsRead(t *testing.T) {
+	r := newStoreReplica(t)
+	// Before histories were kept a version was the id of the last writer
+	assert.Nil(t, r.committedStore.Put("a", "1"))
+	assert.Nil(t, r.versionStore.Put("a", "100"))
+	assert.Nil(t, r.versionStore.Put("b", "200"))
+
+	h, err := r.getHistory("a")
+	assert.Nil(t, err)
+	assert.Equal(t, []version{{CommitTs: "100", Value: []byte("1")}}, h.Versions)
+	h, err = r.getHistory("b")
+	assert.Nil(t, err)
+	assert.Equal(t, []version{{CommitTs: "200", Deleted: true}}, h.Versions)
+
+	assert.Nil(t, r.putVersion("a", version{CommitTs: "300", Value: []byte("2")}))
+	v, err := r.getVersion("a")
+	assert.Nil(t, err)
+	assert.Equal(t, "300", v)
+}
+
+func TestSnapshotGetWaitsForPreparedWriter(t *testing.T) {
+	r := newStoreReplica(t)
+	r.lockTimeout = 20 * time.Millisecond
+	assert.Nil(t, r.committedStore.Put("a", "old"))
+	writer := &common.Tx{Id: "5", State: common.Prepared, Ops: []common.TxOp{{Op: common.PutOp, Key: "a"}}}
+	reader := &common.Tx{Id: "8", State: common.Started}
+	r.txs[writer.Id] = writer
+	r.txs[reader.Id] = reader
+
+	// The writer may commit below the snapshot, so the read can't go on
+	var reply client.TxGetResult
+	assert.Nil(t, r.snapshotGet(reader, "a", "10", &reply))
+	assert.False(t, reply.Success)
+
+	r.lockTimeout = time.Second
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		_ = r.putVersion("a", version{CommitTs: "9", Value: []byte("new")})
+		writer.State = common.Committed
+	}()
+	reply = client.TxGetResult{}
+	assert.Nil(t, r.snapshotGet(reader, "a", "10", &reply))
+	assert.True(t, reply.Success)
+	assert.Equal(t, "new", reply.Value)
+}
@@ -0,0 +1,79 @@
+package replica
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"twopc/pkg/client"
+	"twopc/pkg/common"
+	"twopc/pkg/lock"
+)
+
+// VersionedGet reads the committed value of key along with its version, for
+// optimistic txs. It takes no locks.
+func (r *Replica) VersionedGet(args *client.ReplicaKeyArgs, reply *client.VersionedGetResult) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	reply.Version, err = r.getVersion(args.Key)
+	if err != nil {
+		return
+	}
+	val, err := r.committedStore.Get(args.Key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	reply.Value = val
+	reply.Found = true
+	log.Printf("Replica.VersionedGet: key=%v, version=%v\n", args.Key, reply.Version)
+	return
+}
+
+// TryValidate prepares an optimistic tx that writes nothing here. There is
+// nothing to log; the read locks it leaves behind go away on commit or abort.
+func (r *Replica) TryValidate(args *client.ValidateArgs, reply *client.ReplicaActionResult) (err error) {
+	log.Printf("Replica.TryValidate: reads=%v, txId=%v\n", len(args.Reads), args.TxId)
+	reply.Success = false
+
+	tx, ok := r.beginTx(args.TxId)
+	if !ok {
+		log.Println("Received validate in finished tx:", args.TxId, " Aborting")
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if tx.State != common.Started && tx.State != common.Prepared {
+		return nil
+	}
+	if !r.validateReads(args.TxId, args.Reads) {
+		r.failTx(tx)
+		return nil
+	}
+	reply.Success = true
+	return nil
+}
+
+// validateReads checks that every key txId read is still at the version it
+// saw, and keeps it there with a read lock until the tx ends. A key some other
+// tx is about to write fails validation rather than wait: that write is
+// likely to commit and change the version anyway.
+func (r *Replica) validateReads(txId string, reads []client.ReadVersion) bool {
+	for _, read := range reads {
+		err := r.locks.Lock(txId, read.Key, lock.Shared, 0)
+		if err != nil {
+			log.Println("Validation failed for tx:", txId, "key:", read.Key, "is being written")
+			return false
+		}
+		version, err := r.getVersion(read.Key)
+		if err != nil || version != read.Version {
+			log.Println("Validation failed for tx:", txId, "key:", read.Key, "read version:", read.Version, "current:", version, err)
+			return false
+		}
+	}
+	return true
+}
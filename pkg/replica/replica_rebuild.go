@@ -0,0 +1,142 @@
+package replica
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"time"
+	"twopc/pkg/client"
+	"twopc/pkg/common"
+	"twopc/pkg/io"
+)
+
+// Rebuild turns an empty replica into a copy of another one, from that
+// replica's stores and log as of one log position. Txs that were prepared
+// there are resolved like after a crash, by asking the master.
+func (r *Replica) Rebuild(args *client.SnapshotResult, reply *client.RebuildResult) (err error) {
+	err = r.load(args)
+	if err != nil {
+		return
+	}
+	// Recover asks the master about prepared txs, it mustn't hold mu then
+	err = r.Recover()
+	if err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	log.Printf("Replica.Rebuild: keys=%v, logPosition=%v\n", len(args.Committed), args.LogPosition)
+	reply.Incarnation = r.incarnation
+	return nil
+}
+
+// load writes the stores and log of snapshot into an empty replica.
+func (r *Replica) load(snapshot *client.SnapshotResult) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.isEmpty() {
+		return NotEmptyError
+	}
+
+	err = writeAll(r.raw.committed, snapshot.Committed)
+	if err != nil {
+		return
+	}
+	err = writeAll(r.raw.temp, snapshot.Temp)
+	if err != nil {
+		return
+	}
+	err = writeAll(r.raw.versions, snapshot.Versions)
+	if err != nil {
+		return
+	}
+	err = r.log.WriteRaw(snapshot.Log)
+	if err != nil {
+		return
+	}
+	r.hasData = true
+	return nil
+}
+
+// discard drops everything of a replica that was replaced while it was away,
+// since its data may miss txs decided without it. It comes back empty, ready
+// to be rebuilt.
+func (r *Replica) discard() (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for txId := range r.txs {
+		r.locks.Cancel(txId)
+		r.locks.UnlockAll(txId)
+	}
+	r.txs = make(map[string]*common.Tx)
+	r.inDoubt = make(map[string]time.Time)
+
+	for _, store := range []io.IKeyValueStore{r.committedStore, r.tempStore, r.versionStore} {
+		var keys []string
+		keys, err = store.List()
+		if err != nil {
+			return
+		}
+		for _, key := range keys {
+			err = store.Del(key)
+			if err != nil {
+				return
+			}
+		}
+	}
+	err = r.log.Reset()
+	if err != nil {
+		return
+	}
+	r.hasData = false
+	return r.newIncarnation()
+}
+
+// isEmpty reports whether the replica never held any data. It must be called
+// with mu held.
+func (r *Replica) isEmpty() bool {
+	return !r.hasData && len(r.txs) == 0 && r.log.Position() == 0
+}
+
+// loadIncarnation reads the incarnation of the data directory, starting a new
+// one for a directory that has none yet.
+func (r *Replica) loadIncarnation() (err error) {
+	data, err := os.ReadFile(getIncarnationPath(r.node))
+	if err == nil {
+		r.incarnation = string(data)
+	} else if errors.Is(err, fs.ErrNotExist) {
+		err = r.newIncarnation()
+	}
+	if err != nil {
+		return
+	}
+
+	for _, store := range []io.IKeyValueStore{r.committedStore, r.versionStore} {
+		keys, err := store.List()
+		if err != nil {
+			return err
+		}
+		r.hasData = r.hasData || len(keys) > 0
+	}
+	return nil
+}
+
+func (r *Replica) newIncarnation() (err error) {
+	b := make([]byte, 8)
+	_, err = rand.Read(b)
+	if err != nil {
+		return
+	}
+	err = os.MkdirAll(r.node.DataDir, 0777)
+	if err != nil {
+		return
+	}
+	r.incarnation = hex.EncodeToString(b)
+	return os.WriteFile(getIncarnationPath(r.node), []byte(r.incarnation), 0644)
+}
@@ -0,0 +1,138 @@
+package replica
+
+import (
+	"log"
+	"time"
+	"twopc/pkg/common"
+	"twopc/pkg/io"
+	"twopc/pkg/lock"
+)
+
+// Options control how a replica stores its data and handles lock conflicts.
+type Options struct {
+	// KeyFile, when set, turns on encryption of keys, values and logged keys.
+	// See io.Keyring for the file format.
+	KeyFile string
+	// Compress gzips values that shrink enough to be worth it. Values written
+	// with and without it can be read either way, since compressed ones are
+	// marked by a header.
+	Compress bool
+
+	// LockTimeout is how long a mutation waits in line for a locked key
+	// before voting no. Zero votes no straight away.
+	LockTimeout time.Duration
+	// DeadlockPolicy resolves lock conflicts by tx age. With anything but
+	// lock.WaitForLock deadlocks can't happen and the master's detector is
+	// not needed.
+	DeadlockPolicy lock.Policy
+
+	// LeaseDuration is how long a tx keeps its locks without the master
+	// renewing them. Once it runs out the replica asks the master how the tx
+	// ended. Zero turns leases off.
+	LeaseDuration time.Duration
+	// InDoubtAlert is how long a prepared tx may stay unresolved after its
+	// lease ran out before an alert is logged.
+	InDoubtAlert time.Duration
+}
+
+type storage struct {
+	committedStore io.IKeyValueStore
+	tempStore      io.IKeyValueStore
+	versionStore   io.IKeyValueStore
+	raw            rawStores
+	log            io.ILogger
+}
+
+// rawStores are the stores as written to disk, below any encryption or
+// compression. Snapshots copy them, and bootstrapping fills them.
+type rawStores struct {
+	committed *io.SnapshotStore
+	temp      *io.SnapshotStore
+	versions  *io.SnapshotStore
+}
+
+func (s rawStores) all() []*io.SnapshotStore {
+	return []*io.SnapshotStore{s.committed, s.temp, s.versions}
+}
+
+// freeze freezes every store, or none of them.
+func (s rawStores) freeze() (err error) {
+	for i, store := range s.all() {
+		err = store.Freeze()
+		if err != nil {
+			for _, frozen := range s.all()[:i] {
+				frozen.Thaw()
+			}
+			return
+		}
+	}
+	return nil
+}
+
+func (s rawStores) thaw() {
+	for _, store := range s.all() {
+		store.Thaw()
+	}
+}
+
+func openStorage(node common.NodeConfig, opts Options) (s *storage) {
+	raw := rawStores{
+		committed: io.NewSnapshotStore(io.NewKeyValueStore(getCommittedPath(node))),
+		temp:      io.NewSnapshotStore(io.NewKeyValueStore(getTempPath(node))),
+		versions:  io.NewSnapshotStore(io.NewKeyValueStore(getVersionsPath(node))),
+	}
+	s = &storage{
+		committedStore: raw.committed,
+		tempStore:      raw.temp,
+		versionStore:   raw.versions,
+		raw:            raw,
+		log:            io.NewLogger(getLogPath(node)),
+	}
+
+	if opts.KeyFile != "" {
+		keyring, err := io.LoadKeyring(opts.KeyFile)
+		if err != nil {
+			log.Fatalln("openStorage:", err)
+		}
+		stores := []*io.EncryptedStore{
+			io.NewEncryptedStore(s.committedStore, keyring),
+			io.NewEncryptedStore(s.tempStore, keyring),
+			io.NewEncryptedStore(s.versionStore, keyring),
+		}
+		// Data written without the key file would be unreadable, and its
+		// file names would give the keys away
+		for _, store := range stores {
+			if err := store.Check(); err != nil {
+				log.Fatalln("openStorage:", err, "(encrypt it with rotatekeys first)")
+			}
+		}
+		s.committedStore, s.tempStore, s.versionStore = stores[0], stores[1], stores[2]
+		s.log = io.NewEncryptedLogger(s.log, keyring)
+	}
+	// Compress before encrypting, ciphertext doesn't compress. Values
+	// compressed earlier are read even with compression off.
+	s.committedStore = io.NewCompressedStore(s.committedStore, opts.Compress)
+	s.tempStore = io.NewCompressedStore(s.tempStore, opts.Compress)
+	s.versionStore = io.NewCompressedStore(s.versionStore, opts.Compress)
+	return
+}
+
+// RotateKeys re-encrypts the stores and the log of a stopped replica with the
+// newest key in keyFile, and encrypts what was written without a key file.
+// Retired keys can be dropped from the file afterwards.
+func RotateKeys(node common.NodeConfig, keyFile string) (rotated int, err error) {
+	keyring, err := io.LoadKeyring(keyFile)
+	if err != nil {
+		return
+	}
+	for _, p := range []string{getCommittedPath(node), getTempPath(node), getVersionsPath(node)} {
+		n, err := io.NewEncryptedStore(io.NewKeyValueStore(p), keyring).Rotate()
+		rotated += n
+		if err != nil {
+			return rotated, err
+		}
+	}
+	n, err := io.RotateLog(getLogPath(node), keyring)
+	rotated += n
+	return
+}
@@ -0,0 +1,83 @@
+package ring
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// VirtualNodes is how many points each group gets on the ring. The more
+// points, the more evenly keys spread over the groups.
+const VirtualNodes = 128
+
+// Ring maps keys to replica groups by consistent hashing. A key belongs to
+// the group owning the first point at or after its hash, so adding a group
+// only takes keys from the others, and removing one only hands its keys out.
+type Ring struct {
+	// hashes is sorted, owners[i] is the group at hashes[i].
+	hashes []uint64
+	owners []int
+	groups []int
+}
+
+// New builds the ring of groups. Their order doesn't matter.
+func New(groups []int) *Ring {
+	r := &Ring{}
+	seen := make(map[int]bool)
+	for _, g := range groups {
+		if seen[g] {
+			continue
+		}
+		seen[g] = true
+		r.groups = append(r.groups, g)
+		for i := 0; i < VirtualNodes; i++ {
+			r.hashes = append(r.hashes, hash(fmt.Sprint("group-", g, "-", i)))
+			r.owners = append(r.owners, g)
+		}
+	}
+	sort.Ints(r.groups)
+	sort.Sort(byHash{r})
+	return r
+}
+
+// Locate returns the group owning key, or -1 on an empty ring.
+func (r *Ring) Locate(key string) int {
+	if len(r.hashes) == 0 {
+		return -1
+	}
+	h := hash(key)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[i]
+}
+
+// Groups lists the groups on the ring in ascending order.
+func (r *Ring) Groups() []int {
+	return append([]int(nil), r.groups...)
+}
+
+func hash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+type byHash struct{ r *Ring }
+
+func (b byHash) Len() int { return len(b.r.hashes) }
+
+// Less breaks ties between colliding points by group, so every master
+// builds the same ring.
+func (b byHash) Less(i, j int) bool {
+	if b.r.hashes[i] != b.r.hashes[j] {
+		return b.r.hashes[i] < b.r.hashes[j]
+	}
+	return b.r.owners[i] < b.r.owners[j]
+}
+
+func (b byHash) Swap(i, j int) {
+	b.r.hashes[i], b.r.hashes[j] = b.r.hashes[j], b.r.hashes[i]
+	b.r.owners[i], b.r.owners[j] = b.r.owners[j], b.r.owners[i]
+}
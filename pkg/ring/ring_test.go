@@ -0,0 +1,52 @@
+package ring
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestLocateSingleGroup(t *testing.T) {
+	r := New([]int{3})
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, 3, r.Locate(fmt.Sprint("key", i)))
+	}
+	assert.Equal(t, -1, New(nil).Locate("key"))
+}
+
+func TestLocateIgnoresGroupOrder(t *testing.T) {
+	a := New([]int{0, 1, 2})
+	b := New([]int{2, 0, 1, 0})
+	assert.Equal(t, []int{0, 1, 2}, b.Groups())
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprint("key", i)
+		assert.Equal(t, a.Locate(key), b.Locate(key))
+	}
+}
+
+func TestLocateSpreadsKeys(t *testing.T) {
+	r := New([]int{0, 1, 2, 3})
+	counts := make(map[int]int)
+	for i := 0; i < 10000; i++ {
+		counts[r.Locate(fmt.Sprint("key", i))]++
+	}
+	for g := 0; g < 4; g++ {
+		assert.Greater(t, counts[g], 1500, "group %v", g)
+		assert.Less(t, counts[g], 3500, "group %v", g)
+	}
+}
+
+func TestAddingGroupOnlyMovesKeysToIt(t *testing.T) {
+	before := New([]int{0, 1, 2})
+	after := New([]int{0, 1, 2, 3})
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprint("key", i)
+		if g := after.Locate(key); g != before.Locate(key) {
+			assert.Equal(t, 3, g)
+			moved++
+		}
+	}
+	assert.Greater(t, moved, 1500)
+	assert.Less(t, moved, 3500)
+}